@@ -0,0 +1,174 @@
+/*
+Copyright © 2022 Manish Sharma bhardwaz007@yahoo.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"errors"
+	"geolocation/internal"
+	"geolocation/internal/model"
+	"geolocation/internal/store"
+	"geolocation/internal/utils"
+	"strconv"
+
+	_ "github.com/lib/pq"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// datasetsCmd represents the datasets command
+var datasetsCmd = &cobra.Command{
+	Use:   "datasets",
+	Short: "inspects the ingested dataset versions and switches the served one.",
+	Long: `
+	inspects the ingested dataset versions and switches the served one,
+	every ingestion loads into a new dataset which is only served once the load succeeded.
+
+	#1. list, lists every dataset with its status, size, whether it is being served and, for the dataset of a failed
+	    checkpointed ingestion, the file it can be resumed from (see ingest --resume),
+	#2. activate <version>, serves the given (fully loaded) dataset, and
+	#3. rollback, serves the latest fully loaded dataset older than the one being served.
+	`,
+}
+
+var datasetsListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "lists every dataset with its status, size and whether it is being served",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		logger := utils.GetLogger().WithFields(logrus.Fields{"command": "datasets list"})
+
+		conn, err := openStore(cmd)
+		if err != nil {
+			logger.WithFields(logrus.Fields{"err": err}).Error("openStore() failed")
+			return
+		}
+		defer conn.Close()
+
+		datasets, err := conn.Datasets(cmd.Context())
+		if err != nil {
+			logger.WithFields(logrus.Fields{"err": err}).Error("Datasets() failed")
+			return
+		}
+		for _, d := range datasets {
+			fields := logrus.Fields{"version": d.Version, "status": d.Status, "locations": d.Locations, "active": d.Active}
+			if !d.CreatedAt.IsZero() {
+				fields["created_at"] = d.CreatedAt.Format("2006-01-02T15:04:05Z07:00")
+			}
+			if d.ActivatedAt != nil {
+				fields["activated_at"] = d.ActivatedAt.Format("2006-01-02T15:04:05Z07:00")
+			}
+			if d.Resumable != "" {
+				fields["resumable"] = d.Resumable
+			}
+			logger.WithFields(fields).Info("dataset")
+		}
+	},
+}
+
+var datasetsActivateCmd = &cobra.Command{
+	Use:   "activate <version>",
+	Short: "serves the given, fully loaded, dataset",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		runActivation(cmd, "activate", func(datasets []model.Dataset) (int, error) {
+			version, err := strconv.Atoi(args[0])
+			if err != nil {
+				return 0, errors.New("version must be a number")
+			}
+			return version, nil
+		})
+	},
+}
+
+var datasetsRollbackCmd = &cobra.Command{
+	Use:   "rollback",
+	Short: "serves the latest fully loaded dataset older than the one being served",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		runActivation(cmd, "rollback", func(datasets []model.Dataset) (int, error) {
+			previous := 0
+			for _, d := range datasets {
+				if d.Active {
+					break
+				}
+				if d.Status == model.DatasetReady {
+					previous = d.Version
+				}
+			}
+			if previous == 0 {
+				return 0, errors.New("no fully loaded dataset older than the active one")
+			}
+			return previous, nil
+		})
+	},
+}
+
+// runActivation serves the dataset picked by target out of the current datasets (ordered by version)
+func runActivation(cmd *cobra.Command, name string, target func(datasets []model.Dataset) (int, error)) {
+	logger := utils.GetLogger().WithFields(logrus.Fields{"command": "datasets " + name})
+
+	conn, err := openStore(cmd)
+	if err != nil {
+		logger.WithFields(logrus.Fields{"err": err}).Error("openStore() failed")
+		return
+	}
+	defer conn.Close()
+
+	datasets, err := conn.Datasets(cmd.Context())
+	if err != nil {
+		logger.WithFields(logrus.Fields{"err": err}).Error("Datasets() failed")
+		return
+	}
+	current := 0
+	for _, d := range datasets {
+		if d.Active {
+			current = d.Version
+		}
+	}
+
+	version, err := target(datasets)
+	if err != nil {
+		logger.WithFields(logrus.Fields{"err": err}).Error("invalid dataset")
+		return
+	}
+	if err := conn.ActivateDataset(cmd.Context(), version); err != nil {
+		logger.WithFields(logrus.Fields{"err": err, "from": current, "to": version}).Error("ActivateDataset() failed")
+		return
+	}
+	logger.WithFields(logrus.Fields{"from": current, "to": version}).Info("dataset activated.")
+}
+
+// openStore connects to the configured store and brings its schema up to date
+func openStore(cmd *cobra.Command) (internal.Store, error) {
+	dbCfg, err := utils.GetDBCfg()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := store.New(*dbCfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.Migrate(cmd.Context()); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func init() {
+	rootCmd.AddCommand(datasetsCmd)
+	datasetsCmd.AddCommand(datasetsListCmd, datasetsActivateCmd, datasetsRollbackCmd)
+}
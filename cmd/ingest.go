@@ -16,12 +16,20 @@ limitations under the License.
 package cmd
 
 import (
-	"geolocation/internal/store/database"
+	"context"
+	"errors"
+	"geolocation/internal"
+	"geolocation/internal/model"
+	"geolocation/internal/store"
 	"geolocation/internal/utils"
 	"geolocation/pkg/service"
-	"io/fs"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
 
 	_ "github.com/lib/pq"
 	"github.com/sirupsen/logrus"
@@ -31,16 +39,33 @@ import (
 // ingestCmd represents the ingest command
 var ingestCmd = &cobra.Command{
 	Use:   "ingest",
-	Short: "reads a csv file named '*.csv' from the mounted location.",
+	Short: "reads a csv, tsv or ndjson file from the mounted location.",
 	Long: `
-	reads a csv file named '*.csv' from the mounted location.
-	(for local debugging the file has to be present @ root)
-	After the read is complete, the data will be loaded in database and 
+	reads a csv ('*.csv'), tsv ('*.tsv' or '*.tab') or ndjson ('*.ndjson' or '*.jsonl') file from the mounted location,
+	the format is told by the file's extension unless given with --format.
+	(for local debugging the file has to be present @ root), '-' reads it from stdin,
+	an http(s):// URL downloads it unless unchanged since last ingested (ETag & Last-Modified) and
+	an s3://bucket/key URL reads it from S3 compatible object storage (see S3_*).
+	The file may be gzip ('*.csv.gz'), zstd ('*.csv.zst') or zip compressed, told by its content,
+	every csv, tsv & ndjson member of a zip archive gets ingested in order into the same dataset.
+	A directory or glob (e.g. 'shards/*.csv.gz') ingests every file it holds, as does a manifest (see --manifest)
+	listing files along with their checksums, all in order into the same dataset.
+	Columns are found by their header name, in any order (see INGEST_COLUMN_* to configure aliases).
+	The file is streamed, sanitised concurrently (see --validators) & valid entries are loaded batch by batch
+	(see --batch-size, --memory-limit & --writers) in a new dataset of the database, which gets served only once the load succeeded (see datasets),
+	the progress of a single local file gets checkpointed in the store with --checkpoint, so a failed ingestion can be continued with --resume,
+	whereas --dry-run only validates the file (e.g. ahead of a release) without ever touching the store,
+	the progress gets logged every so often (see --progress), --mode=sync deletes the locations the file no longer holds,
+	--watch keeps ingesting every dump dropped into a directory, and
 	a detailed output will be presented with following details:
 	
 	#1. total time taken to parse & load the data in millisecond,
-	#2. number of entries accepted, and
-	#3. number of entries discarded.
+	#2. number of entries accepted,
+	#3. number of entries discarded, broken down by reason & column (see --rejects to find out which rows),
+	    along with exact & conflicting duplicates (see --duplicates),
+	#4. number of accepted entries inserted, updated & skipped (see --on-conflict), and
+	#5. version of the dataset now being served,
+	file by file when ingesting several.
 	`,
 	Run: func(cmd *cobra.Command, args []string) {
 		// initialise a common logger
@@ -48,64 +73,455 @@ var ingestCmd = &cobra.Command{
 			"command": "ingest",
 		})
 
-		// make sure the provided file (or default) is a csv file, or fail fast
+		// a dry run exits non-zero on any failure (e.g. an invalid header or too many discarded rows), so that it can gate a release
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+		failed := true
+		defer func() {
+			if dryRun && failed {
+				os.Exit(1)
+			}
+		}()
+		if dryRun {
+			logger = logger.WithFields(logrus.Fields{"dry-run": true})
+		}
+
+		// make sure the given format (if any) is a known one, or fail fast
 		file := cmd.Flag("file").Value.String()
-		if filepath.Ext(file) != ".csv" {
-			logger.Error("invalid file format, only csv is supported")
+		format := service.Format(cmd.Flag("format").Value.String())
+		if format != "" && format != service.FormatCSV && format != service.FormatTSV && format != service.FormatNDJSON {
+			logger.WithFields(logrus.Fields{"format": format}).Error("invalid file format, only csv, tsv & ndjson are supported")
 			return
 		}
 
-		// open file or fail fast
-		r, err := os.OpenFile(file, os.O_RDONLY, fs.FileMode(os.O_RDONLY))
-		if err != nil {
-			logger.WithFields(logrus.Fields{"err": err}).Error("OpenFile() failed")
+		// make sure the loader is a known one, or fail fast
+		loader := model.Loader(cmd.Flag("loader").Value.String())
+		if loader != model.LoaderInsert && loader != model.LoaderCopy {
+			logger.WithFields(logrus.Fields{"loader": loader}).Error("invalid loader, only insert & copy are supported")
+			return
+		}
+
+		// make sure the conflict policy is a known one, or fail fast
+		onConflict := model.ConflictPolicy(cmd.Flag("on-conflict").Value.String())
+		if onConflict != model.ConflictSkip && onConflict != model.ConflictUpdate && onConflict != model.ConflictFail {
+			logger.WithFields(logrus.Fields{"on-conflict": onConflict}).Error("invalid conflict policy, only skip, update & fail are supported")
+			return
+		}
+
+		// make sure the mode is a known one, a synced dump updating changed locations whatever --on-conflict, or fail fast
+		mode := service.Mode(cmd.Flag("mode").Value.String())
+		if mode != service.ModeAppend && mode != service.ModeSync {
+			logger.WithFields(logrus.Fields{"mode": mode}).Error("invalid mode, only append & sync are supported")
+			return
+		}
+		if mode == service.ModeSync && cmd.Flags().Changed("on-conflict") && onConflict != model.ConflictUpdate {
+			logger.WithFields(logrus.Fields{"on-conflict": onConflict}).Error("invalid conflict policy, a synced dump always updates changed locations")
+			return
+		}
+
+		// make sure the duplicate policy is a known one, or fail fast
+		duplicates := service.DuplicatePolicy(cmd.Flag("duplicates").Value.String())
+		if duplicates != service.DuplicateFirst && duplicates != service.DuplicateLast && duplicates != service.DuplicateRejectConflicting && duplicates != service.DuplicateMajority {
+			logger.WithFields(logrus.Fields{"duplicates": duplicates}).Error("invalid duplicate policy, only first, last, reject-all-conflicting & majority are supported")
+			return
+		}
+		duplicatesLimit, err := cmd.Flags().GetInt("duplicates-limit")
+		if err != nil || duplicatesLimit <= 0 {
+			logger.WithFields(logrus.Fields{"duplicates-limit": cmd.Flag("duplicates-limit").Value}).Error("invalid duplicates limit, it must be a positive number")
+			return
+		}
+
+		// make sure batches are bounded, or fail fast
+		batchSize, err := cmd.Flags().GetInt("batch-size")
+		if err != nil || batchSize <= 0 {
+			logger.WithFields(logrus.Fields{"batch-size": cmd.Flag("batch-size").Value}).Error("invalid batch size, it must be a positive number")
+			return
+		}
+		memoryLimit, err := cmd.Flags().GetInt("memory-limit")
+		if err != nil || memoryLimit < 0 {
+			logger.WithFields(logrus.Fields{"memory-limit": cmd.Flag("memory-limit").Value}).Error("invalid memory limit, it must be 0 (no limit) or a positive number of MiB")
 			return
 		}
-		defer r.Close()
 
-		// load db config or fail fast
-		dbCfg, err := utils.GetDBCfg()
+		// make sure every stage has workers, or fail fast
+		validators, err := cmd.Flags().GetInt("validators")
+		if err != nil || validators <= 0 {
+			logger.WithFields(logrus.Fields{"validators": cmd.Flag("validators").Value}).Error("invalid number of validators, it must be a positive number")
+			return
+		}
+		writers, err := cmd.Flags().GetInt("writers")
+		if err != nil || writers <= 0 {
+			logger.WithFields(logrus.Fields{"writers": cmd.Flag("writers").Value}).Error("invalid number of writers, it must be a positive number")
+			return
+		}
+
+		// make sure the threshold is either disabled or a percentage, or fail fast
+		maxDiscarded, err := cmd.Flags().GetFloat64("max-discarded")
+		if err != nil || (maxDiscarded != -1 && (maxDiscarded < 0 || maxDiscarded > 100)) {
+			logger.WithFields(logrus.Fields{"max-discarded": cmd.Flag("max-discarded").Value}).Error("invalid max discarded, it must be -1 (disabled) or a percentage between 0 & 100")
+			return
+		}
+
+		// make sure progress gets reported every so often (if at all), or fail fast
+		progressInterval, err := cmd.Flags().GetDuration("progress")
+		if err != nil || progressInterval < 0 {
+			logger.WithFields(logrus.Fields{"progress": cmd.Flag("progress").Value}).Error("invalid progress interval, it must be 0 (never) or a positive duration")
+			return
+		}
+
+		// load the column mapping or fail fast
+		columnsCfg, err := utils.GetColumnsCfg()
 		if err != nil {
-			logger.WithFields(logrus.Fields{"err": err}).Error("GetDBCfg() failed")
+			logger.WithFields(logrus.Fields{"err": err}).Error("GetColumnsCfg() failed")
 			return
 		}
 
-		// create database connection or fail fast
-		conn, err := database.New(*dbCfg)
+		// create the rejects file, if asked for, or fail fast
+		opts := service.IngestOptions{
+			Write:           model.WriteOptions{Loader: loader, OnConflict: onConflict},
+			Columns:         *columnsCfg,
+			Duplicates:      duplicates,
+			DuplicatesLimit: duplicatesLimit,
+			Mode:            mode,
+			BatchSize:       batchSize,
+			MemoryLimit:     memoryLimit << 20,
+			Validators:      validators,
+			Writers:         writers,
+			DryRun:          dryRun,
+		}
+		if progressInterval > 0 {
+			opts.Progress = func(p model.Progress) { logProgress(logger, p) }
+			opts.ProgressInterval = progressInterval
+		}
+		if rejectsFile := cmd.Flag("rejects").Value.String(); rejectsFile != "" {
+			rejects, err := os.Create(rejectsFile)
+			if err != nil {
+				logger.WithFields(logrus.Fields{"err": err}).Error("Create() failed")
+				return
+			}
+			defer rejects.Close()
+			opts.Rejects = rejects
+		}
+
+		// connect to the store, unless it's a dry run which never touches it
+		var conn internal.Store
+		if !dryRun {
+			// load db config or fail fast
+			dbCfg, err := utils.GetDBCfg()
+			if err != nil {
+				logger.WithFields(logrus.Fields{"err": err}).Error("GetDBCfg() failed")
+				return
+			}
+
+			// create store (database or in-memory) connection or fail fast
+			if conn, err = store.New(*dbCfg); err != nil {
+				logger.WithFields(logrus.Fields{"err": err}).Error("NewConnection() failed")
+				return
+			}
+			defer conn.Close()
+
+			// run migration
+			if err := conn.Migrate(cmd.Context()); err != nil {
+				logger.WithFields(logrus.Fields{"err": err}).Error("Migrate() failed")
+				return
+			}
+		}
+
+		// watch a directory, ingesting every dump dropped into it one at a time, till interrupted
+		if watch := cmd.Flag("watch").Value.String(); watch != "" {
+			resume, _ := cmd.Flags().GetBool("resume")
+			checkpoint, _ := cmd.Flags().GetBool("checkpoint")
+			if dryRun || resume || checkpoint || cmd.Flag("manifest").Value.String() != "" {
+				logger.Error("invalid watch, a watched directory can't be dry run, checkpointed, resumed nor listed in a manifest")
+				return
+			}
+			settle, err := cmd.Flags().GetDuration("settle")
+			if err != nil || settle <= 0 {
+				logger.WithFields(logrus.Fields{"settle": cmd.Flag("settle").Value}).Error("invalid settle time, it must be a positive duration")
+				return
+			}
+			ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			watcher := service.NewWatcher(watch, service.WatchOptions{Archive: cmd.Flag("archive").Value.String(), Settle: settle})
+			logger.WithFields(logrus.Fields{"dir": watch}).Info("watching for dumps ...")
+			err = watcher.Watch(ctx, func(ctx context.Context, path string) error {
+				logger := logger.WithFields(logrus.Fields{"file": path})
+				stat, err := ingestDump(ctx, logger, conn, path, format, opts)
+				if err != nil {
+					logger.WithFields(logrus.Fields{"err": err}).Error("Ingest() failed")
+					return err
+				}
+				logStat(logger, stat)
+				return nil
+			})
+			if err != nil {
+				logger.WithFields(logrus.Fields{"err": err}).Error("Watch() failed")
+				return
+			}
+			logger.Info("watching stopped.")
+			return
+		}
+
+		// list the files of the dump, out of the manifest (verifying their checksums) or the given file, directory or glob
+		paths := []string{}
+		if manifest := cmd.Flag("manifest").Value.String(); manifest != "" {
+			entries, err := service.ReadManifest(manifest)
+			if err != nil {
+				logger.WithFields(logrus.Fields{"err": err}).Error("ReadManifest() failed")
+				return
+			}
+			for _, entry := range entries {
+				if err := entry.Verify(); err != nil {
+					logger.WithFields(logrus.Fields{"err": err}).Error("Verify() failed")
+					return
+				}
+				paths = append(paths, entry.Path)
+			}
+		} else if paths, err = service.Expand(file); err != nil {
+			logger.WithFields(logrus.Fields{"err": err}).Error("Expand() failed")
+			return
+		}
+
+		// open every file (a local file, stdin, an http or s3 URL), skipping the ones unchanged since last ingested, or fail fast
+		s3Cfg, err := utils.GetS3Cfg()
 		if err != nil {
-			logger.WithFields(logrus.Fields{"err": err}).Error("NewConnection() failed")
+			logger.WithFields(logrus.Fields{"err": err}).Error("GetS3Cfg() failed")
 			return
 		}
-		defer conn.Close()
+		files, sources, release, err := openDump(cmd.Context(), logger, paths, conn, *s3Cfg)
+		defer release()
+		if err != nil {
+			logger.WithFields(logrus.Fields{"err": err}).Error("openDump() failed")
+			return
+		}
+		if len(files) == 0 {
+			failed = false
+			return
+		}
+
+		// make sure every file is of a known format, or fail fast
+		if format == "" {
+			for _, f := range files {
+				if _, err := service.FormatOf(f.Name); err != nil {
+					logger.WithFields(logrus.Fields{"err": err}).Error("FormatOf() failed")
+					return
+				}
+			}
+		}
 
-		// run migration
-		if err := conn.Migrate(cmd.Context()); err != nil {
-			logger.WithFields(logrus.Fields{"err": err}).Error("Migrate() failed")
+		// record checkpoints of a single local file, identified by its checksum, so that a failed ingestion can be resumed,
+		// only when asked to (--checkpoint or --resume) as checksumming takes a whole extra read of the file
+		resume, _ := cmd.Flags().GetBool("resume")
+		checkpoint, _ := cmd.Flags().GetBool("checkpoint")
+		if checkpoint = checkpoint || resume; checkpoint && dryRun {
+			logger.Error("invalid checkpoint, a dry run can't be checkpointed nor resumed")
+			return
+		}
+		if checkpoint && mode == service.ModeSync {
+			logger.Error("invalid checkpoint, a synced dump can't be checkpointed nor resumed")
+			return
+		}
+		if checkpoint && len(paths) == 1 && len(files) == 1 && paths[0] != service.Stdin && !strings.Contains(paths[0], "://") {
+			path, err := filepath.Abs(paths[0])
+			if err != nil {
+				logger.WithFields(logrus.Fields{"err": err}).Error("Abs() failed")
+				return
+			}
+			checksum, err := service.Checksum(path)
+			if err != nil {
+				logger.WithFields(logrus.Fields{"err": err}).Error("Checksum() failed")
+				return
+			}
+			opts.Checkpoint, opts.Resume = &model.Checkpoint{File: path, Checksum: checksum}, resume
+		} else if checkpoint {
+			logger.WithFields(logrus.Fields{"file": file}).Error("invalid checkpoint, only the ingestion of a single local file can be checkpointed & resumed")
 			return
 		}
 
 		// initialise ingestor service
-		ingestorSrvc := service.NewCSVIngestor(conn, r)
+		ingestorSrvc := service.NewFilesIngestor(conn, files, format, opts)
 
 		// read, sanitise & ingest all valid locations
 		logger.Debug("ingestion in progress ...")
-		stat, _, err := ingestorSrvc.Ingest(cmd.Context())
+		stat, err := ingestorSrvc.Ingest(cmd.Context())
 		if err != nil {
 			logger.WithFields(logrus.Fields{"err": err}).Error("Ingest() failed")
 			return
 		}
 
 		// display stats
-		logger.WithFields(logrus.Fields{
-			"accepted":        stat.Accepted,
-			"discarded":       stat.Discarded,
-			"spent (ms)":      stat.TimeSpent.Milliseconds(),
-			"total record(s)": stat.Accepted + stat.Discarded,
-		}).Info("ingestion complete.")
+		logStat(logger, stat)
+
+		// fail a dry run discarding too many rows
+		if total := stat.Accepted + stat.Discarded; dryRun && maxDiscarded >= 0 && total > 0 && float64(stat.Discarded)*100 > maxDiscarded*float64(total) {
+			logger.WithFields(logrus.Fields{"discarded (%)": float64(stat.Discarded) * 100 / float64(total), "max-discarded": maxDiscarded}).Error("too many discarded rows")
+			return
+		}
+		failed = false
+
+		// remember the dump as ingested, so that it gets skipped until it changes
+		for _, source := range sources {
+			if err := source.Ingested(cmd.Context()); err != nil {
+				logger.WithFields(logrus.Fields{"err": err}).Error("Ingested() failed")
+			}
+		}
 	},
 }
 
+// openDump opens every file of a dump & decompresses it (see service.Unpack), files unchanged since last ingested are skipped.
+// Returns the files to ingest along with their sources, release closes them all
+func openDump(ctx context.Context, logger *logrus.Entry, paths []string, conn internal.Store, s3Cfg model.S3) ([]service.File, []service.Source, func(), error) {
+	files, sources, releases := []service.File{}, []service.Source{}, []func(){}
+	release := func() {
+		for i := len(releases) - 1; i >= 0; i-- {
+			releases[i]()
+		}
+	}
+	for _, path := range paths {
+		source, err := service.NewSource(path, conn, s3Cfg)
+		if err != nil {
+			return nil, nil, release, err
+		}
+		r, err := source.Open(ctx)
+		if errors.Is(err, service.ErrNotModified) {
+			logger.WithFields(logrus.Fields{"file": path}).Info("dump not modified since last ingested, skipping.")
+			continue
+		}
+		if err != nil {
+			return nil, nil, release, err
+		}
+		releases = append(releases, func() { r.Close() })
+
+		// decompress the file (gzip, zstd or zip, told by its magic bytes)
+		unpacked, unpackRelease, err := service.Unpack(source.Name(), r)
+		if err != nil {
+			return nil, nil, release, err
+		}
+		releases = append(releases, unpackRelease)
+		files = append(files, unpacked...)
+		sources = append(sources, source)
+	}
+	return files, sources, release, nil
+}
+
+// ingestDump ingests a single local dump (possibly compressed), e.g. one dropped into a watched directory
+func ingestDump(ctx context.Context, logger *logrus.Entry, conn internal.Store, path string, format service.Format, opts service.IngestOptions) (*model.Stat, error) {
+	files, _, release, err := openDump(ctx, logger, []string{path}, conn, model.S3{})
+	defer release()
+	if err != nil {
+		return nil, err
+	}
+	if format == "" {
+		for _, f := range files {
+			if _, err := service.FormatOf(f.Name); err != nil {
+				return nil, err
+			}
+		}
+	}
+	logger.Debug("ingestion in progress ...")
+	return service.NewFilesIngestor(conn, files, format, opts).Ingest(ctx)
+}
+
+// logProgress displays how far an ongoing ingestion got, the completed ingestion gets displayed by logStat
+func logProgress(logger *logrus.Entry, p model.Progress) {
+	if p.Done {
+		return
+	}
+	fields := logrus.Fields{
+		"read":        p.Read,
+		"accepted":    p.Accepted,
+		"discarded":   p.Discarded,
+		"read (MiB)":  p.Bytes >> 20,
+		"rows/s":      int(p.Rate),
+		"elapsed (s)": int(p.Elapsed.Seconds()),
+	}
+	if p.File != "" {
+		fields["file"] = p.File
+	}
+	if p.Scanning {
+		fields["scanning"] = true
+	}
+	if p.Size > 0 {
+		fields["done (%)"] = p.Bytes * 100 / p.Size
+		fields["eta (s)"] = int(p.ETA.Seconds())
+	}
+	logger.WithFields(fields).Info("ingestion in progress ...")
+}
+
+// logStat displays the outcome of an ingestion, file by file when there were several,
+// along with the breakdown of discarded rows
+func logStat(logger *logrus.Entry, stat *model.Stat) {
+	for _, file := range stat.Files {
+		logger.WithFields(logrus.Fields{
+			"file":            file.Name,
+			"accepted":        file.Accepted,
+			"discarded":       file.Discarded,
+			"duplicates":      file.Duplicates,
+			"conflicting":     file.ConflictingDuplicates,
+			"inserted":        file.Inserted,
+			"updated":         file.Updated,
+			"skipped":         file.Skipped,
+			"spent (ms)":      file.TimeSpent.Milliseconds(),
+			"total record(s)": file.Accepted + file.Discarded,
+		}).Info("file ingested.")
+	}
+	logger.WithFields(logrus.Fields{
+		"dataset":         stat.Dataset,
+		"run":             stat.RunID,
+		"resumed at":      stat.ResumedAt,
+		"accepted":        stat.Accepted,
+		"discarded":       stat.Discarded,
+		"duplicates":      stat.Duplicates,
+		"conflicting":     stat.ConflictingDuplicates,
+		"inserted":        stat.Inserted,
+		"updated":         stat.Updated,
+		"skipped":         stat.Skipped,
+		"deleted":         stat.Deleted,
+		"spent (ms)":      stat.TimeSpent.Milliseconds(),
+		"writing (ms)":    stat.WriteTime.Milliseconds(),
+		"batches":         stat.Batches,
+		"total record(s)": stat.Accepted + stat.Discarded,
+	}).Info("ingestion complete.")
+	if stat.Untracked > 0 {
+		logger.WithFields(logrus.Fields{"untracked": stat.Untracked}).Warn("duplicates limit reached, duplicates of the untracked rows were left to --on-conflict.")
+	}
+	if stat.Discarded == 0 {
+		return
+	}
+	reasons := logrus.Fields{}
+	for reason, n := range stat.DiscardedBy {
+		reasons[string(reason)] = n
+	}
+	logger.WithFields(reasons).Info("discarded rows by reason.")
+	if len(stat.DiscardedColumns) > 0 {
+		columns := logrus.Fields{}
+		for column, n := range stat.DiscardedColumns {
+			columns[column] = n
+		}
+		logger.WithFields(columns).Info("discarded rows by column.")
+	}
+}
+
 func init() {
 	rootCmd.AddCommand(ingestCmd)
-	ingestCmd.Flags().StringP("file", "f", "data_dump.csv", "csv file name to ingest data from")
+	ingestCmd.Flags().StringP("file", "f", "data_dump.csv", "csv, tsv or ndjson file to ingest data from (a path, directory, glob, - for stdin, an http(s):// or s3://bucket/key URL), possibly gzip, zstd or zip compressed")
+	ingestCmd.Flags().String("manifest", "", "file listing the files to ingest, one '<checksum>  <file>' (as output by sha256sum or md5sum) per line, overrides --file")
+	ingestCmd.Flags().String("format", "", "format of the file: csv, tsv or ndjson, told by the file's extension when empty")
+	ingestCmd.Flags().String("on-conflict", string(model.ConflictSkip), "what to do with locations already stored: skip (keep the stored one), update (overwrite it) or fail (abort the ingestion)")
+	ingestCmd.Flags().String("mode", string(service.ModeAppend), "append (add the file to the served locations) or sync (make them mirror the file: insert new, update changed & delete absent locations)")
+	ingestCmd.Flags().String("duplicates", string(service.DuplicateFirst), "which of the rows sharing an ip address gets ingested: first, last, reject-all-conflicting (none, if they disagree) or majority (the data most rows agree on), all but first read the file twice, every policy takes memory per network (see --duplicates-limit)")
+	ingestCmd.Flags().Int("duplicates-limit", service.DefaultDuplicatesLimit, "most networks tracked to settle duplicates (roughly 100 bytes each), beyond it first leaves duplicates to --on-conflict & any other policy fails")
+	ingestCmd.Flags().Int("batch-size", service.DefaultBatchSize, "most locations buffered in memory (per writer) before they get written to the store")
+	ingestCmd.Flags().Int("memory-limit", 64, "most memory (MiB) buffered locations may take before they get written to the store, 0 for no limit")
+	ingestCmd.Flags().Int("validators", runtime.NumCPU(), "number of workers sanitising rows concurrently")
+	ingestCmd.Flags().Int("writers", 1, "number of workers writing batches to the store concurrently")
+	ingestCmd.Flags().String("rejects", "", "csv file name to write every discarded row to, along with its line number & the reason it got discarded for")
+	ingestCmd.Flags().Bool("checkpoint", false, "checkpoint the progress of a single local file in the store after every committed batch (checksumming the file first), so a failed ingestion can be resumed")
+	ingestCmd.Flags().Bool("resume", false, "continue the failed ingestion of the same (unchanged) file right after its last committed batch, rows written since by other writers are written again as per --on-conflict")
+	ingestCmd.Flags().Bool("dry-run", false, "read, sanitise & report on the file without touching the store, exiting non-zero on failure (see --max-discarded)")
+	ingestCmd.Flags().Float64("max-discarded", -1, "percentage (0 to 100) of discarded rows above which a dry run fails, -1 disables the check")
+	ingestCmd.Flags().Duration("progress", 10*time.Second, "how often the progress of the ingestion gets logged (rows, bytes, rows/s & ETA), 0 to never log it")
+	ingestCmd.Flags().String("watch", "", "directory to watch, every dump dropped into it gets ingested (one at a time) once complete, then archived, till interrupted")
+	ingestCmd.Flags().String("archive", "", "directory watched dumps are moved to once ingested, the archive directory within the watched one by default (failed ones go to the failed directory within the watched one)")
+	ingestCmd.Flags().Duration("settle", service.DefaultSettle, "how long a watched file must go unchanged before it's deemed complete")
+	ingestCmd.Flags().String("loader", string(model.LoaderInsert), "how locations are written to postgres: insert (batched INSERTs) or copy (COPY protocol, faster for large dumps)")
 }
@@ -0,0 +1,186 @@
+/*
+Copyright © 2022 Manish Sharma bhardwaz007@yahoo.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"errors"
+	"geolocation/internal"
+	"geolocation/internal/model"
+	"geolocation/internal/store"
+	"geolocation/internal/utils"
+	"strconv"
+
+	_ "github.com/lib/pq"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// migrateCmd represents the migrate command
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "manages versioned database schema migrations.",
+	Long: `
+	manages versioned database schema migrations,
+	every applied migration is tracked in the 'schema_migrations' table.
+
+	#1. up, applies every pending migration,
+	#2. down, reverts the latest applied migration (or the given number of them),
+	#3. status, lists every migration and whether it has been applied, and
+	#4. to <version>, applies or reverts migrations until the schema is at <version>.
+	`,
+}
+
+var migrateUpCmd = &cobra.Command{
+	Use:   "up",
+	Short: "applies every pending migration",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		runMigration(cmd, "up", func(status []model.Migration) (int, error) {
+			return status[len(status)-1].Version, nil
+		})
+	},
+}
+
+var migrateDownCmd = &cobra.Command{
+	Use:   "down [steps]",
+	Short: "reverts the latest applied migration, or the given number of them",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		steps := 1
+		if len(args) == 1 {
+			n, err := strconv.Atoi(args[0])
+			if err != nil || n < 1 {
+				utils.GetLogger().WithFields(logrus.Fields{"command": "migrate down", "steps": args[0]}).Error("steps must be a positive number")
+				return
+			}
+			steps = n
+		}
+		runMigration(cmd, "down", func(status []model.Migration) (int, error) {
+			applied := []int{}
+			for _, m := range status {
+				if m.AppliedAt != nil {
+					applied = append(applied, m.Version)
+				}
+			}
+			if steps >= len(applied) {
+				return 0, nil
+			}
+			return applied[len(applied)-steps-1], nil
+		})
+	},
+}
+
+var migrateToCmd = &cobra.Command{
+	Use:   "to <version>",
+	Short: "applies or reverts migrations until the schema is at the given version",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		runMigration(cmd, "to", func(status []model.Migration) (int, error) {
+			version, err := strconv.Atoi(args[0])
+			if err != nil {
+				return 0, errors.New("version must be a number")
+			}
+			return version, nil
+		})
+	},
+}
+
+var migrateStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "lists every migration and whether it has been applied",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		logger := utils.GetLogger().WithFields(logrus.Fields{"command": "migrate status"})
+
+		migrator, closeFn, err := openMigrator()
+		if err != nil {
+			logger.WithFields(logrus.Fields{"err": err}).Error("openMigrator() failed")
+			return
+		}
+		defer closeFn()
+
+		status, err := migrator.Migrations(cmd.Context())
+		if err != nil {
+			logger.WithFields(logrus.Fields{"err": err}).Error("Migrations() failed")
+			return
+		}
+		for _, m := range status {
+			fields := logrus.Fields{"version": m.Version, "name": m.Name, "applied": m.AppliedAt != nil}
+			if m.AppliedAt != nil {
+				fields["applied_at"] = m.AppliedAt.Format("2006-01-02T15:04:05Z07:00")
+			}
+			logger.WithFields(fields).Info("migration")
+		}
+	},
+}
+
+// runMigration migrates the schema to the version picked by target out of the current migration status
+func runMigration(cmd *cobra.Command, name string, target func(status []model.Migration) (int, error)) {
+	logger := utils.GetLogger().WithFields(logrus.Fields{"command": "migrate " + name})
+
+	migrator, closeFn, err := openMigrator()
+	if err != nil {
+		logger.WithFields(logrus.Fields{"err": err}).Error("openMigrator() failed")
+		return
+	}
+	defer closeFn()
+
+	status, err := migrator.Migrations(cmd.Context())
+	if err != nil {
+		logger.WithFields(logrus.Fields{"err": err}).Error("Migrations() failed")
+		return
+	}
+	current := 0
+	for _, m := range status {
+		if m.AppliedAt != nil {
+			current = m.Version
+		}
+	}
+
+	version, err := target(status)
+	if err != nil {
+		logger.WithFields(logrus.Fields{"err": err}).Error("invalid migration target")
+		return
+	}
+	if err := migrator.MigrateTo(cmd.Context(), version); err != nil {
+		logger.WithFields(logrus.Fields{"err": err, "from": current, "to": version}).Error("MigrateTo() failed")
+		return
+	}
+	logger.WithFields(logrus.Fields{"from": current, "to": version}).Info("migration complete.")
+}
+
+// openMigrator connects to the configured store, which must support versioned migrations
+func openMigrator() (internal.Migrator, func(), error) {
+	dbCfg, err := utils.GetDBCfg()
+	if err != nil {
+		return nil, nil, err
+	}
+	conn, err := store.New(*dbCfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	migrator, ok := conn.(internal.Migrator)
+	if !ok {
+		conn.Close()
+		return nil, nil, errors.New("driver " + dbCfg.Driver + " does not support versioned migrations")
+	}
+	return migrator, func() { conn.Close() }, nil
+}
+
+func init() {
+	rootCmd.AddCommand(migrateCmd)
+	migrateCmd.AddCommand(migrateUpCmd, migrateDownCmd, migrateStatusCmd, migrateToCmd)
+}
@@ -30,14 +30,16 @@ var rootCmd = &cobra.Command{
 	Long: `
 	geolocation is a CLI App which does the task of resolving 
 	an IP Address to Country, City, Latitude & Longitude.
-	It does so after ingesting location data from a '*.csv' file .
+	It does so after ingesting location data from a '*.csv' (or tsv, ndjson) file .
 	
-	For doing that it exposes 2 commands:
+	For doing that it exposes 4 commands:
 
 	#1. ingest
 	#2. serve 
+	#3. migrate
+	#4. datasets
 
-	For more details run --help on commands [ingest, serve]
+	For more details run --help on commands [ingest, serve, migrate, datasets]
 	`,
 }
 
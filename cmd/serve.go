@@ -17,7 +17,7 @@ package cmd
 
 import (
 	"fmt"
-	"geolocation/internal/store/database"
+	"geolocation/internal/store"
 	"geolocation/internal/utils"
 	"geolocation/pkg/service"
 	"net/http"
@@ -39,6 +39,8 @@ var serveCmd = &cobra.Command{
 	the server exposes an endpoint named 'resolve' - 
 	which can be accessed as http://localhost:<port>/resolve?ip=123.456.789.487 
  	resolves the provided ip address to JSON object containing Country, City, Latitude & Longitude etc.
+	a POST to the same endpoint with a JSON array of ip addresses as body, e.g. ["1.2.3.4", "2001:db8::1"]
+	resolves all of them at once, responding with a JSON array holding a status (and location) per ip address.
 	`,
 	Run: func(cmd *cobra.Command, args []string) {
 		// initialise a common logger
@@ -54,8 +56,8 @@ var serveCmd = &cobra.Command{
 			return
 		}
 
-		// create database connection or fail fast
-		conn, err := database.New(*dbCfg)
+		// create store (database or in-memory) connection or fail fast
+		conn, err := store.New(*dbCfg)
 		if err != nil {
 			logger.WithFields(logrus.Fields{"err": err}).Error("NewConnection() failed")
 			return
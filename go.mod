@@ -1,9 +1,11 @@
 module geolocation
 
-go 1.17
+go 1.19
 
 require (
+	github.com/fsnotify/fsnotify v1.5.1
 	github.com/jmoiron/sqlx v1.3.4
+	github.com/klauspost/compress v1.15.15
 	github.com/lib/pq v1.2.0
 	github.com/sirupsen/logrus v1.8.1
 	github.com/spf13/cobra v1.4.0
@@ -13,7 +15,6 @@ require (
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
-	github.com/fsnotify/fsnotify v1.5.1 // indirect
 	github.com/hashicorp/hcl v1.0.0 // indirect
 	github.com/inconshreveable/mousetrap v1.0.0 // indirect
 	github.com/kr/pretty v0.2.0 // indirect
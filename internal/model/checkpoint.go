@@ -0,0 +1,20 @@
+package model
+
+import "time"
+
+// Checkpoint records how far the ingestion of a file got, every row up to Line (ending at byte Offset)
+// has been written to the (loading) Dataset, so that a failed ingestion can be resumed from there
+type Checkpoint struct {
+	// RunID identifies the ingestion, a resumed ingestion keeps it
+	RunID string `json:"runId"`
+	File  string `json:"file"`
+	// Checksum (sha256) of the file, a file which changed since can't be resumed
+	Checksum string `json:"checksum"`
+	Dataset  int    `json:"dataset"`
+	// Base is the version of the dataset which was active when Dataset got copied from it (0 when none was),
+	// once another dataset got activated since the ingestion can't be resumed
+	Base      int       `json:"base"`
+	Line      int       `json:"line"`
+	Offset    int64     `json:"offset"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
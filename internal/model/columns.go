@@ -0,0 +1,13 @@
+package model
+
+// Columns names the csv columns holding every field of a location by their header, aliases included,
+// on top of the field's own name (e.g. ip_address)
+type Columns struct {
+	IPAddress    []string `mapstructure:"INGEST_COLUMN_IP_ADDRESS"`
+	CountryCode  []string `mapstructure:"INGEST_COLUMN_COUNTRY_CODE"`
+	Country      []string `mapstructure:"INGEST_COLUMN_COUNTRY"`
+	City         []string `mapstructure:"INGEST_COLUMN_CITY"`
+	Latitude     []string `mapstructure:"INGEST_COLUMN_LATITUDE"`
+	Longitude    []string `mapstructure:"INGEST_COLUMN_LONGITUDE"`
+	MysteryValue []string `mapstructure:"INGEST_COLUMN_MYSTERY_VALUE"`
+}
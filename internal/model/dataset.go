@@ -0,0 +1,25 @@
+package model
+
+import "time"
+
+// DatasetStatus tells whether a dataset is still being loaded
+type DatasetStatus string
+
+const (
+	// DatasetLoading is a dataset being written to, never served
+	DatasetLoading DatasetStatus = "loading"
+	// DatasetReady is a fully loaded dataset which is (or has been, or can be) served
+	DatasetReady DatasetStatus = "ready"
+)
+
+// Dataset is one version of the location data, only the active dataset is served
+type Dataset struct {
+	Version     int           `json:"version"`
+	Status      DatasetStatus `json:"status"`
+	Locations   int           `json:"locations"`
+	Active      bool          `json:"active"`
+	CreatedAt   time.Time     `json:"createdAt"`
+	ActivatedAt *time.Time    `json:"activatedAt"`
+	// Resumable names the file whose failed ingestion can be resumed into this (loading) dataset, if any
+	Resumable string `json:"resumable,omitempty"`
+}
@@ -1,5 +1,7 @@
 package model
 
+import "time"
+
 type DB struct {
 	Host     string `mapstructure:"DB_HOST"`
 	Port     int    `mapstructure:"BD_PORT"`
@@ -7,4 +9,9 @@ type DB struct {
 	Password string `mapstructure:"DB_PASSWORD"`
 	Database string `mapstructure:"DB_DATABASE"`
 	Driver   string `mapstructure:"DB_DRIVER"`
+	Snapshot string `mapstructure:"DB_SNAPSHOT"`
+	// StatementTimeout bounds every statement, e.g. 5s, unbounded when empty
+	StatementTimeout time.Duration `mapstructure:"DB_STATEMENT_TIMEOUT"`
+	// DatasetRetention is the number of inactive datasets kept around for rollbacks, 3 when empty
+	DatasetRetention int `mapstructure:"DB_DATASET_RETENTION"`
 }
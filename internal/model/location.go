@@ -2,6 +2,7 @@ package model
 
 type Location struct {
 	IPAddress    string      `json:"ip_address"`
+	Network      string      `json:"network,omitempty"`
 	CountryCode  string      `json:"country_code"`
 	Country      string      `json:"country"`
 	City         string      `json:"city"`
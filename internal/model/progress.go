@@ -0,0 +1,26 @@
+package model
+
+import "time"
+
+// Progress is how far an ongoing ingestion got, reported periodically while it runs
+type Progress struct {
+	// File is the file being read, empty when ingesting a single one
+	File string `json:"file,omitempty"`
+	// Scanning tells rows are only being scanned for duplicates, every file gets read (& accounted for) again afterwards
+	Scanning bool `json:"scanning,omitempty"`
+	// Read is the number of rows read so far, by every pass over the files
+	Read      int `json:"read"`
+	Accepted  int `json:"accepted"`
+	Discarded int `json:"discarded"`
+	// Bytes is the number of (decompressed) bytes consumed so far, out of Size
+	Bytes int64 `json:"bytes"`
+	// Size is the number of bytes to consume in total, 0 when unknown (e.g. for compressed files)
+	Size    int64         `json:"size,omitempty"`
+	Elapsed time.Duration `json:"elapsed"`
+	// Rate is the number of rows read per second
+	Rate float64 `json:"rate"`
+	// ETA is the time left, estimated out of the bytes consumed so far, 0 when Size is unknown
+	ETA time.Duration `json:"eta,omitempty"`
+	// Done tells the ingestion completed, it's the last report
+	Done bool `json:"done,omitempty"`
+}
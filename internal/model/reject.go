@@ -0,0 +1,32 @@
+package model
+
+// RejectReason is a machine-readable code telling why an ingested row got discarded
+type RejectReason string
+
+const (
+	// RejectMalformed is a row which can't be parsed in the format of the file (e.g. invalid json)
+	RejectMalformed RejectReason = "malformed_row"
+	// RejectColumnCount is a row without exactly as many columns as the header
+	RejectColumnCount RejectReason = "bad_column_count"
+	// RejectIPAddress is a row whose ip address is missing or invalid
+	RejectIPAddress RejectReason = "bad_ip_address"
+	// RejectNetwork is a row whose network isn't valid CIDR notation
+	RejectNetwork RejectReason = "bad_network"
+	// RejectCountryCode is a row without a country code
+	RejectCountryCode RejectReason = "empty_country_code"
+	// RejectCountry is a row without a country
+	RejectCountry RejectReason = "empty_country"
+	// RejectCity is a row without a city
+	RejectCity RejectReason = "empty_city"
+	// RejectLatitude is a row whose latitude can't be parsed
+	RejectLatitude RejectReason = "bad_latitude"
+	// RejectLongitude is a row whose longitude can't be parsed
+	RejectLongitude RejectReason = "bad_longitude"
+	// RejectMysteryValue is a row whose mystery value isn't numeric
+	RejectMysteryValue RejectReason = "bad_mystery_value"
+	// RejectDuplicate is a row identical to the row ingested for its ip address (or network) from the same file
+	RejectDuplicate RejectReason = "duplicate"
+	// RejectConflictingDuplicate is a row sharing its ip address (or network) with a row of the same file
+	// yet disagreeing with the one ingested (if any, see the duplicate policy)
+	RejectConflictingDuplicate RejectReason = "conflicting_duplicate"
+)
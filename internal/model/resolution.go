@@ -0,0 +1,10 @@
+package model
+
+// Resolution is the outcome of resolving one ip address out of a batch,
+// Status mirrors the http status a single resolution would have answered with
+type Resolution struct {
+	IP       string    `json:"ip"`
+	Status   int       `json:"status"`
+	Error    string    `json:"error,omitempty"`
+	Location *Location `json:"location,omitempty"`
+}
@@ -0,0 +1,26 @@
+package model
+
+import "time"
+
+// Source records the remote dump (http or s3 URL) a dataset was last ingested from,
+// so that an unchanged dump doesn't get downloaded & ingested again
+type Source struct {
+	URL string `json:"url"`
+	// ETag & LastModified are the validators the dump was served with, either may be empty
+	ETag         string    `json:"etag"`
+	LastModified string    `json:"lastModified"`
+	IngestedAt   time.Time `json:"ingestedAt"`
+}
+
+// S3 configures the S3 compatible object storage dumps get read from (s3://bucket/key)
+type S3 struct {
+	// Endpoint is the base URL of the storage, e.g. http://minio:9000, AWS when empty
+	Endpoint        string `mapstructure:"S3_ENDPOINT"`
+	Region          string `mapstructure:"S3_REGION"`
+	AccessKeyID     string `mapstructure:"S3_ACCESS_KEY_ID"`
+	SecretAccessKey string `mapstructure:"S3_SECRET_ACCESS_KEY"`
+	SessionToken    string `mapstructure:"S3_SESSION_TOKEN"`
+	// PathStyle addresses buckets as <endpoint>/<bucket>/<key> rather than <bucket>.<endpoint>/<key>,
+	// as most S3 compatible storages expect
+	PathStyle bool `mapstructure:"S3_PATH_STYLE"`
+}
@@ -3,7 +3,64 @@ package model
 import "time"
 
 type Stat struct {
+	// Dataset is the version of the dataset the locations were loaded into
+	Dataset int `json:"dataset"`
+	// RunID identifies an ingestion recording checkpoints (see Checkpoint)
+	RunID string `json:"runId,omitempty"`
+	// ResumedAt is the line a resumed ingestion continued after, 0 when it started from scratch
+	ResumedAt int           `json:"resumedAt,omitempty"`
 	TimeSpent time.Duration `json:"timeSpent"`
-	Accepted  int           `json:"accepted"`
-	Discarded int           `json:"discarded"`
+	// WriteTime is the part of TimeSpent spent writing to the store
+	WriteTime time.Duration `json:"writeTime"`
+	// Batches is the number of writes the accepted locations were flushed in
+	Batches   int `json:"batches"`
+	Accepted  int `json:"accepted"`
+	Discarded int `json:"discarded"`
+	// DiscardedBy breaks the discarded rows down by the reason they got discarded for
+	DiscardedBy map[RejectReason]int `json:"discardedBy,omitempty"`
+	// DiscardedColumns breaks the discarded rows down by the (first) column failing validation,
+	// rows discarded as a whole (e.g. for their column count or as duplicates) aren't counted
+	DiscardedColumns map[string]int `json:"discardedColumns,omitempty"`
+	// Duplicates is the number of rows discarded as identical to the row ingested for their ip address (or network)
+	Duplicates int `json:"duplicates"`
+	// ConflictingDuplicates is the number of rows discarded as sharing their ip address (or network) with another row
+	// yet disagreeing with the one ingested
+	ConflictingDuplicates int `json:"conflictingDuplicates"`
+	// Untracked is the number of rows ingested without settling their duplicates, as too many networks were tracked
+	// already, duplicates among them were resolved by the conflict policy of the store
+	Untracked int `json:"untracked,omitempty"`
+	// WriteStat breaks the accepted locations down by what the store did with them
+	WriteStat
+	// Files breaks an ingestion of several files down by file, in the order they were ingested
+	Files []FileStat `json:"files,omitempty"`
+}
+
+// FileStat is the share of a single file in an ingestion of several files
+type FileStat struct {
+	Name string `json:"name"`
+	Stat
+}
+
+// Add adds up the counts of another ingestion (or part of one), the dataset & time spent are left as is
+func (s *Stat) Add(other Stat) {
+	s.WriteTime += other.WriteTime
+	s.Batches += other.Batches
+	s.Accepted += other.Accepted
+	s.Discarded += other.Discarded
+	for reason, n := range other.DiscardedBy {
+		if s.DiscardedBy == nil {
+			s.DiscardedBy = map[RejectReason]int{}
+		}
+		s.DiscardedBy[reason] += n
+	}
+	for column, n := range other.DiscardedColumns {
+		if s.DiscardedColumns == nil {
+			s.DiscardedColumns = map[string]int{}
+		}
+		s.DiscardedColumns[column] += n
+	}
+	s.Duplicates += other.Duplicates
+	s.ConflictingDuplicates += other.ConflictingDuplicates
+	s.Untracked += other.Untracked
+	s.WriteStat.Add(other.WriteStat)
 }
@@ -0,0 +1,48 @@
+package model
+
+// Loader picks how a store writes locations in bulk
+type Loader string
+
+const (
+	// LoaderInsert writes locations with batched multi-row INSERT statements
+	LoaderInsert Loader = "insert"
+	// LoaderCopy streams locations with the COPY protocol into a staging table before merging them
+	LoaderCopy Loader = "copy"
+)
+
+// ConflictPolicy picks what happens to a location whose ip address (or network) is already stored
+type ConflictPolicy string
+
+const (
+	// ConflictSkip keeps the stored location
+	ConflictSkip ConflictPolicy = "skip"
+	// ConflictUpdate overwrites the stored location
+	ConflictUpdate ConflictPolicy = "update"
+	// ConflictFail aborts the whole write
+	ConflictFail ConflictPolicy = "fail"
+)
+
+// WriteOptions tune how BulkCreate writes locations, the zero value inserts into the active dataset & skips conflicts
+type WriteOptions struct {
+	Loader     Loader
+	OnConflict ConflictPolicy
+	// Dataset is the version of the dataset to write to, 0 being the active one
+	Dataset int
+}
+
+// WriteStat counts the outcome of writing locations
+type WriteStat struct {
+	Inserted int `json:"inserted"`
+	Updated  int `json:"updated"`
+	Skipped  int `json:"skipped"`
+	// Deleted is the number of stored locations deleted as absent from a synced dump (see DeleteAbsent)
+	Deleted int `json:"deleted"`
+}
+
+// Add accumulates the outcome of another write
+func (w *WriteStat) Add(other WriteStat) {
+	w.Inserted += other.Inserted
+	w.Updated += other.Updated
+	w.Skipped += other.Skipped
+	w.Deleted += other.Deleted
+}
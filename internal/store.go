@@ -9,10 +9,46 @@ import (
 type Store interface {
 	// Migrate meant to run migration script (if any)
 	Migrate(ctx context.Context) error
-	// BulkCreate is meant to do bulk insertion of data
-	BulkCreate(ctx context.Context, locations []model.Location) error
-	// Get is meant to retrieve data on the basis of IP address
+	// BulkCreate is meant to do bulk insertion of data, resolving already stored locations as per opts.OnConflict
+	BulkCreate(ctx context.Context, locations []model.Location, opts model.WriteOptions) (model.WriteStat, error)
+	// Get is meant to retrieve data of the most specific network (longest prefix) containing the IP address
 	Get(ctx context.Context, ipAddress string) (*model.Location, error)
+	// MarkPresent is meant to record the locations of a synced dump as present in the dataset picked by opts.Dataset,
+	// matched the way BulkCreate matches conflicts, whether they got written or not
+	MarkPresent(ctx context.Context, locations []model.Location, opts model.WriteOptions) error
+	// DeleteAbsent is meant to delete every location of the dataset picked by opts.Dataset which wasn't marked present,
+	// then forget the marks, returning how many got deleted
+	DeleteAbsent(ctx context.Context, opts model.WriteOptions) (int, error)
+	// GetMany is meant to resolve many IP addresses at once, keyed by their canonical form,
+	// addresses which can't be resolved are left out
+	GetMany(ctx context.Context, ipAddresses []string) (map[string]*model.Location, error)
+	// CreateDataset is meant to create a new, inactive dataset seeded with the active one for an ingestion to write to,
+	// which costs a copy of the active dataset
+	CreateDataset(ctx context.Context) (*model.Dataset, error)
+	// ActivateDataset is meant to atomically switch the served dataset, pruning inactive datasets beyond retention
+	ActivateDataset(ctx context.Context, version int) error
+	// DropDataset is meant to discard an inactive dataset, e.g. after a failed ingestion
+	DropDataset(ctx context.Context, version int) error
+	// Datasets is meant to list every dataset, oldest first
+	Datasets(ctx context.Context) ([]model.Dataset, error)
+	// Source is meant to tell which version of a remote dump got ingested last, utils.ErrNotFound when none did
+	Source(ctx context.Context, url string) (*model.Source, error)
+	// SaveSource is meant to record the version of a remote dump once it got ingested
+	SaveSource(ctx context.Context, source model.Source) error
+	// Checkpoint is meant to tell how far the last ingestion of a file got, utils.ErrNotFound when it completed (or never ran)
+	Checkpoint(ctx context.Context, file string) (*model.Checkpoint, error)
+	// SaveCheckpoint is meant to record how far the ingestion of a file got, replacing its previous checkpoint
+	SaveCheckpoint(ctx context.Context, checkpoint model.Checkpoint) error
+	// DeleteCheckpoint is meant to forget the checkpoint of a file once its ingestion completed
+	DeleteCheckpoint(ctx context.Context, file string) error
 	// Close is meant to close the connection
 	Close() error
 }
+
+// Migrator is implemented by stores whose schema is versioned
+type Migrator interface {
+	// MigrateTo is meant to apply or revert migrations until the schema is at the given version
+	MigrateTo(ctx context.Context, version int) error
+	// Migrations is meant to list every known migration along with when it was applied (if at all)
+	Migrations(ctx context.Context) ([]model.Migration, error)
+}
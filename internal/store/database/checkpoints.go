@@ -0,0 +1,71 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"geolocation/internal/model"
+	"geolocation/internal/utils"
+)
+
+const (
+	checkpointQuery     = `SELECT run_id, file, checksum, dataset, base, line, byte_offset, updated_at FROM checkpoints WHERE file = $1`
+	saveCheckpointQuery = `INSERT INTO checkpoints (file, run_id, checksum, dataset, base, line, byte_offset) VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (file) DO UPDATE SET run_id = EXCLUDED.run_id, checksum = EXCLUDED.checksum, dataset = EXCLUDED.dataset,
+		base = EXCLUDED.base, line = EXCLUDED.line, byte_offset = EXCLUDED.byte_offset, updated_at = now()`
+	deleteCheckpointQuery = `DELETE FROM checkpoints WHERE file = $1`
+)
+
+// Checkpoint returns how far the last ingestion of a file got
+func (s *Connection) Checkpoint(ctx context.Context, file string) (*model.Checkpoint, error) {
+	if s.closed {
+		return nil, utils.ErrInvalidConn
+	}
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	get, err := s.statements.prepare(ctx, checkpointQuery)
+	if err != nil {
+		return nil, err
+	}
+	c := model.Checkpoint{}
+	if err := get.QueryRowContext(ctx, file).Scan(&c.RunID, &c.File, &c.Checksum, &c.Dataset, &c.Base, &c.Line, &c.Offset, &c.UpdatedAt); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, utils.ErrNotFound
+		}
+		return nil, err
+	}
+	return &c, nil
+}
+
+// SaveCheckpoint records how far the ingestion of a file got, replacing its previous checkpoint
+func (s *Connection) SaveCheckpoint(ctx context.Context, c model.Checkpoint) error {
+	if s.closed {
+		return utils.ErrInvalidConn
+	}
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	save, err := s.statements.prepare(ctx, saveCheckpointQuery)
+	if err != nil {
+		return err
+	}
+	_, err = save.ExecContext(ctx, c.File, c.RunID, c.Checksum, c.Dataset, c.Base, c.Line, c.Offset)
+	return err
+}
+
+// DeleteCheckpoint forgets the checkpoint of a file
+func (s *Connection) DeleteCheckpoint(ctx context.Context, file string) error {
+	if s.closed {
+		return utils.ErrInvalidConn
+	}
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	del, err := s.statements.prepare(ctx, deleteCheckpointQuery)
+	if err != nil {
+		return err
+	}
+	_, err = del.ExecContext(ctx, file)
+	return err
+}
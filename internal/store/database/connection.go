@@ -2,20 +2,49 @@ package database
 
 import (
 	"context"
+	"database/sql"
 	"errors"
 	"fmt"
 	"geolocation/internal/model"
 	"geolocation/internal/utils"
 	"strconv"
-	"strings"
+	"time"
 
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 )
 
-// Connection wraps a physical database connection
+const (
+	// the staging table lives as long as the transaction loading it
+	stagingTable        = "geolocation_staging"
+	createStagingScript = `CREATE TEMP TABLE geolocation_staging (LIKE geolocation INCLUDING DEFAULTS) ON COMMIT DROP`
+
+	getQuery = `SELECT ip_network, country_code, country, city, latitude, longitude, mystery_value
+		FROM geolocation WHERE ip_network >>= $1::inet ORDER BY masklen(ip_network) DESC LIMIT 1`
+
+	// getManyQuery resolves every address of the array argument in one round trip,
+	// the ordinality maps each row back to its position in the argument
+	getManyQuery = `SELECT q.i, g.ip_network, g.country_code, g.country, g.city, g.latitude, g.longitude, g.mystery_value
+		FROM unnest($1::inet[]) WITH ORDINALITY AS q(ip, i)
+		JOIN LATERAL (
+			SELECT ip_network, country_code, country, city, latitude, longitude, mystery_value
+			FROM geolocation WHERE ip_network >>= q.ip ORDER BY masklen(ip_network) DESC LIMIT 1
+		) g ON true`
+
+	// uniqueViolation is the postgres error code of a duplicate key
+	uniqueViolation = "23505"
+)
+
+// locationColumns lists the geolocation columns written by BulkCreate, in the order values are supplied
+var locationColumns = []string{"ip_address", "ip_network", "country_code", "country", "city", "latitude", "longitude", "mystery_value"}
+
+// Connection wraps a physical database connection along with the statements prepared on it
 type Connection struct {
-	db     *sqlx.DB
-	closed bool
+	db         *sqlx.DB
+	statements *statements
+	timeout    time.Duration
+	retention  int
+	closed     bool
 }
 
 // New creates new databse connection
@@ -29,23 +58,54 @@ func New(cfg model.DB) (*Connection, error) {
 	if err = db.Ping(); err != nil {
 		return nil, err
 	}
-	return &Connection{db, false}, nil
+	retention := cfg.DatasetRetention
+	if retention <= 0 {
+		retention = utils.DefaultDatasetRetention
+	}
+	return &Connection{db: db, statements: newStatements(db), timeout: cfg.StatementTimeout, retention: retention}, nil
 }
 
-// Migrate runs migration on database
-func (s *Connection) Migrate(ctx context.Context) error {
+// BulkCreate inserts locations data in the dataset table picked by opts.Dataset,
+// either in batched INSERTs or through COPY (see model.Loader),
+// locations already present are skipped, updated or fail the whole call as per the conflict policy
+func (s *Connection) BulkCreate(ctx context.Context, locations []model.Location, opts model.WriteOptions) (model.WriteStat, error) {
 	if s.closed {
-		return utils.ErrInvalidConn
+		return model.WriteStat{}, utils.ErrInvalidConn
+	}
+	// postgres can't touch the same row twice in one statement, so settle duplicates upfront
+	locations, duplicates := utils.DedupeLocations(locations, opts.OnConflict)
+	if duplicates > 0 && opts.OnConflict == model.ConflictFail {
+		return model.WriteStat{}, fmt.Errorf("%w: %d duplicate location(s) in the same write", utils.ErrConflict, duplicates)
 	}
-	_, err := s.db.Exec(utils.CreateTableScript)
-	return err
-}
 
-// BulkCreate inserts locations data in database
-func (s *Connection) BulkCreate(ctx context.Context, locations []model.Location) error {
-	if s.closed {
-		return utils.ErrInvalidConn
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return model.WriteStat{}, err
 	}
+	defer tx.Rollback()
+
+	table, err := s.datasetTableOf(ctx, tx, opts.Dataset)
+	if err != nil {
+		return model.WriteStat{}, err
+	}
+	var stat model.WriteStat
+	if opts.Loader == model.LoaderCopy {
+		stat, err = s.copyIn(ctx, tx, table, locations, opts.OnConflict)
+	} else {
+		stat, err = s.insert(ctx, tx, table, locations, opts.OnConflict)
+	}
+	if err != nil {
+		return model.WriteStat{}, conflictErr(err)
+	}
+	if err := tx.Commit(); err != nil {
+		return model.WriteStat{}, err
+	}
+	stat.Skipped += duplicates
+	return stat, nil
+}
+
+// insert writes locations in batches of multi-row INSERTs
+func (s *Connection) insert(ctx context.Context, tx *sqlx.Tx, table string, locations []model.Location, policy model.ConflictPolicy) (model.WriteStat, error) {
 	var size int = 1000
 	batches := [][]model.Location{}
 	if size <= 0 || size > len(locations) {
@@ -61,72 +121,279 @@ func (s *Connection) BulkCreate(ctx context.Context, locations []model.Location)
 		}
 	}
 
-	success := false
-	tx, err := s.db.Begin()
+	insert, err := s.statements.prepareAs(ctx, "insert "+string(policy), insertQuery(table, policy))
 	if err != nil {
-		return err
+		return model.WriteStat{}, err
 	}
-	defer func() {
-		if success {
-			tx.Commit()
-		} else {
-			tx.Rollback()
-		}
-	}()
-
+	stmt := tx.StmtxContext(ctx, insert)
+	stat := model.WriteStat{}
 	for _, batch := range batches {
-		vals := make([]string, 0, len(batch))
-		args := make([]interface{}, 0, len(batch)*3)
-		i := 0
-		idx := 0
-		for _, row := range batch {
-			idx = i * 7
-			vals = append(vals, fmt.Sprintf("($%d, $%d, $%d, $%d, $%d, $%d, $%d)", idx+1, idx+2, idx+3, idx+4, idx+5, idx+6, idx+7))
-			args = append(args, row.IPAddress)
-			args = append(args, row.CountryCode)
-			args = append(args, row.Country)
-			args = append(args, row.City)
-			args = append(args, row.Latitude)
-			args = append(args, row.Longitude)
-			args = append(args, row.MysteryValue.(string))
-			i++
-		}
-		qry := fmt.Sprintf("INSERT INTO geolocation (ip_address, country_code, country, city, latitude, longitude, mystery_value) VALUES %s ON CONFLICT (ip_address) DO NOTHING",
-			strings.Join(vals, ","))
-		_, err := s.db.ExecContext(ctx, qry, args...)
+		written, err := s.write(ctx, stmt, len(batch), columns(batch)...)
 		if err != nil {
+			return model.WriteStat{}, err
+		}
+		stat.Inserted += written.Inserted
+		stat.Updated += written.Updated
+		stat.Skipped += written.Skipped
+	}
+	return stat, nil
+}
+
+// copyRows streams n rows, the values of columns each, into table with the COPY protocol
+func copyRows(ctx context.Context, tx *sqlx.Tx, table string, columns []string, n int, values func(i int) []interface{}) error {
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn(table, columns...))
+	if err != nil {
+		return err
+	}
+	for i := 0; i < n; i++ {
+		if _, err := stmt.ExecContext(ctx, values(i)...); err != nil {
+			stmt.Close()
 			return err
 		}
 	}
-	success = true
-	return nil
+	// an argument-less Exec flushes the buffered rows & completes the COPY
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		stmt.Close()
+		return err
+	}
+	return stmt.Close()
+}
+
+// copyIn streams locations with the COPY protocol into a transaction scoped staging table,
+// then merges the staging table into the dataset table with the same conflict semantics as insert
+func (s *Connection) copyIn(ctx context.Context, tx *sqlx.Tx, table string, locations []model.Location, policy model.ConflictPolicy) (model.WriteStat, error) {
+	if _, err := tx.ExecContext(ctx, createStagingScript); err != nil {
+		return model.WriteStat{}, err
+	}
+	err := copyRows(ctx, tx, stagingTable, locationColumns, len(locations), func(i int) []interface{} {
+		row := locations[i]
+		var mysteryValue interface{}
+		if row.MysteryValue != nil {
+			mysteryValue = fmt.Sprint(row.MysteryValue)
+		}
+		return []interface{}{row.IPAddress, utils.NetworkOf(row), row.CountryCode, row.Country, row.City, row.Latitude, row.Longitude, mysteryValue}
+	})
+	if err != nil {
+		return model.WriteStat{}, err
+	}
+
+	// the staging table is only visible to this transaction, so is the statement merging it
+	merge, err := tx.PreparexContext(ctx, mergeStagingQuery(table, policy))
+	if err != nil {
+		return model.WriteStat{}, err
+	}
+	defer merge.Close()
+	return s.write(ctx, merge, len(locations))
+}
+
+// MarkPresent records the ip addresses of the locations as present in the dataset table picked by opts.Dataset,
+// they're streamed with the COPY protocol into the present table of the dataset (see presentTable)
+func (s *Connection) MarkPresent(ctx context.Context, locations []model.Location, opts model.WriteOptions) error {
+	if s.closed {
+		return utils.ErrInvalidConn
+	}
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	table, err := s.datasetTableOf(ctx, tx, opts.Dataset)
+	if err != nil {
+		return err
+	}
+	if err := s.createPresentTable(ctx, table); err != nil {
+		return err
+	}
+	err = copyRows(ctx, tx, presentTable(table), []string{"ip_address"}, len(locations), func(i int) []interface{} {
+		return []interface{}{locations[i].IPAddress}
+	})
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
-// Get returns a geolocation data matching the give ip address
+// DeleteAbsent deletes every location of the dataset table picked by opts.Dataset whose ip address wasn't marked present,
+// then drops the present table of the dataset, all in one transaction
+func (s *Connection) DeleteAbsent(ctx context.Context, opts model.WriteOptions) (int, error) {
+	if s.closed {
+		return 0, utils.ErrInvalidConn
+	}
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	table, err := s.datasetTableOf(ctx, tx, opts.Dataset)
+	if err != nil {
+		return 0, err
+	}
+	// nothing marked present at all still means every location is absent
+	if err := s.createPresentTable(ctx, table); err != nil {
+		return 0, err
+	}
+	deleteCtx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	result, err := tx.ExecContext(deleteCtx, deleteAbsentQuery(table))
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.ExecContext(ctx, "DROP TABLE "+presentTable(table)); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return int(deleted), nil
+}
+
+// Get returns the geolocation data of the most specific network containing the give ip address,
+// the address is canonicalised first so that any IPv4 or IPv6 notation matches the ingested row
 func (s *Connection) Get(ctx context.Context, ip string) (*model.Location, error) {
 	if s.closed {
 		return nil, utils.ErrInvalidConn
 	}
-	qry := fmt.Sprintf("SELECT country_code, country, city, latitude, longitude, mystery_value FROM geolocation WHERE ip_address = '%v'", ip)
-	rows, err := s.db.QueryContext(ctx, qry)
+	valid, ip := utils.IsIPValid(ip)
+	if !valid {
+		return nil, utils.ErrBadRequest
+	}
+
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	get, err := s.statements.prepare(ctx, getQuery)
+	if err != nil {
+		return nil, err
+	}
+	location := model.Location{IPAddress: ip}
+	var mysteryValue sql.NullString
+	err = get.QueryRowContext(ctx, ip).Scan(&location.Network, &location.CountryCode, &location.Country, &location.City, &location.Latitude, &location.Longitude, &mysteryValue)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, utils.ErrNotFound
+		}
+		return nil, errors.New("error scanning detail of ip: " + location.IPAddress + ", err: " + err.Error())
+	}
+	if mysteryValue.Valid {
+		location.MysteryValue = mysteryValue.String
+	}
+	return &location, nil
+}
+
+// GetMany returns the geolocation data of the most specific network containing each ip address in a single round trip,
+// keyed by canonical ip address
+func (s *Connection) GetMany(ctx context.Context, ips []string) (map[string]*model.Location, error) {
+	if s.closed {
+		return nil, utils.ErrInvalidConn
+	}
+	canonical := make(pq.StringArray, 0, len(ips))
+	for _, ip := range ips {
+		valid, ip := utils.IsIPValid(ip)
+		if !valid {
+			return nil, utils.ErrBadRequest
+		}
+		canonical = append(canonical, ip)
+	}
+
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	getMany, err := s.statements.prepare(ctx, getManyQuery)
 	if err != nil {
 		return nil, err
 	}
-	location := model.Location{}
-	if rows.Next() {
-		err = rows.Scan(&location.CountryCode, &location.Country, &location.City, &location.Latitude, &location.Longitude, &location.MysteryValue)
+	rows, err := getMany.QueryContext(ctx, canonical)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	locations := make(map[string]*model.Location, len(canonical))
+	for rows.Next() {
+		var i int
+		location := model.Location{}
+		var mysteryValue sql.NullString
+		err = rows.Scan(&i, &location.Network, &location.CountryCode, &location.Country, &location.City, &location.Latitude, &location.Longitude, &mysteryValue)
 		if err != nil {
-			return nil, errors.New("error scanning detail of ip: " + location.IPAddress + ", err: " + err.Error())
+			return nil, errors.New("error scanning detail of ips, err: " + err.Error())
+		}
+		location.IPAddress = canonical[i-1]
+		if mysteryValue.Valid {
+			location.MysteryValue = mysteryValue.String
 		}
-		return &location, nil
+		locations[location.IPAddress] = &location
 	}
-	return nil, utils.ErrNotFound
+	return locations, rows.Err()
 }
 
-// Close closes the database connection
+// Close releases the prepared statements & closes the database connection
 func (s *Connection) Close() error {
 	if s.closed {
 		return utils.ErrInvalidConn
 	}
+	s.closed = true
+	s.statements.reset()
 	return s.db.DB.Close()
 }
+
+// write executes a prepared write statement of total rows (see countWritten) bounded by the statement timeout
+func (s *Connection) write(ctx context.Context, stmt *sqlx.Stmt, total int, args ...interface{}) (model.WriteStat, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	stat := model.WriteStat{}
+	if err := stmt.QueryRowContext(ctx, args...).Scan(&stat.Inserted, &stat.Updated); err != nil {
+		return model.WriteStat{}, err
+	}
+	stat.Skipped = total - stat.Inserted - stat.Updated
+	return stat, nil
+}
+
+// withTimeout bounds ctx by the configured statement timeout (if any),
+// an earlier deadline already set on ctx (e.g. by the http request) always wins
+func (s *Connection) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, s.timeout)
+}
+
+// columns turns a batch of locations into one array argument per column of insertQuery
+func columns(batch []model.Location) []interface{} {
+	ips := make(pq.StringArray, 0, len(batch))
+	networks := make(pq.StringArray, 0, len(batch))
+	countryCodes := make(pq.StringArray, 0, len(batch))
+	countries := make(pq.StringArray, 0, len(batch))
+	cities := make(pq.StringArray, 0, len(batch))
+	latitudes := make(pq.Float64Array, 0, len(batch))
+	longitudes := make(pq.Float64Array, 0, len(batch))
+	mysteryValues := make([]sql.NullString, 0, len(batch))
+	for _, row := range batch {
+		ips = append(ips, row.IPAddress)
+		networks = append(networks, utils.NetworkOf(row))
+		countryCodes = append(countryCodes, row.CountryCode)
+		countries = append(countries, row.Country)
+		cities = append(cities, row.City)
+		latitudes = append(latitudes, row.Latitude)
+		longitudes = append(longitudes, row.Longitude)
+		mysteryValue := sql.NullString{}
+		if row.MysteryValue != nil {
+			mysteryValue = sql.NullString{String: fmt.Sprint(row.MysteryValue), Valid: true}
+		}
+		mysteryValues = append(mysteryValues, mysteryValue)
+	}
+	return []interface{}{ips, networks, countryCodes, countries, cities, latitudes, longitudes, pq.Array(mysteryValues)}
+}
+
+// conflictErr wraps a duplicate key violation into utils.ErrConflict
+func conflictErr(err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == uniqueViolation {
+		return fmt.Errorf("%w: %s", utils.ErrConflict, pqErr.Detail)
+	}
+	return err
+}
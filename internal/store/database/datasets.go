@@ -0,0 +1,283 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"geolocation/internal/model"
+	"geolocation/internal/utils"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	// datasetLockID is the advisory lock key serialising dataset lifecycle changes
+	datasetLockID = 7366129
+	// presentLockID is the advisory lock key serialising the creation of present tables
+	presentLockID = 7366130
+
+	nextDatasetQuery   = `SELECT coalesce(max(version), 0) + 1 FROM datasets`
+	activeDatasetQuery = `SELECT version FROM datasets WHERE active`
+	datasetQuery       = `SELECT status, active FROM datasets WHERE version = $1`
+	datasetsQuery      = `SELECT d.version, d.status, d.locations, d.active, d.created_at, d.activated_at, COALESCE(c.file, '') FROM datasets d
+		LEFT JOIN checkpoints c ON c.dataset = d.version AND d.status = 'loading' ORDER BY d.version`
+	createDatasetQuery = `INSERT INTO datasets (version, status) VALUES ($1, 'loading')`
+	readyDatasetQuery  = `UPDATE datasets SET status = 'ready', locations = $2 WHERE version = $1`
+	deactivateQuery    = `UPDATE datasets SET active = false WHERE active`
+	activateQuery      = `UPDATE datasets SET active = true, activated_at = now() WHERE version = $1`
+	expiredQuery       = `SELECT version FROM datasets WHERE NOT active AND status = 'ready' ORDER BY version DESC OFFSET $1`
+	deleteDatasetQuery = `DELETE FROM datasets WHERE version = $1`
+)
+
+// datasetTable returns the table holding a dataset
+func datasetTable(version int) string {
+	return fmt.Sprintf("geolocation_%d", version)
+}
+
+// presentTable returns the table marking the ip addresses of a synced dump present in a dataset table (see MarkPresent),
+// it only exists from the first mark till the absent locations get deleted
+func presentTable(table string) string {
+	return table + "_present"
+}
+
+// createPresentTable creates the present table of a dataset table unless it exists already, the writers of a sync
+// marking locations concurrently are serialised so that only one creates it
+func (s *Connection) createPresentTable(ctx context.Context, table string) error {
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1)", presentLockID); err != nil {
+		return err
+	}
+	// unlogged, it only matters till the dataset gets activated
+	if _, err := tx.ExecContext(ctx, "CREATE UNLOGGED TABLE IF NOT EXISTS "+presentTable(table)+" (ip_address inet not null)"); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// CreateDataset creates a new loading dataset as a copy of the active one (indexes included),
+// the copy takes time & disk space in proportion to the active dataset, whatever the size of the dump loaded into it
+func (s *Connection) CreateDataset(ctx context.Context) (*model.Dataset, error) {
+	if s.closed {
+		return nil, utils.ErrInvalidConn
+	}
+	tx, err := s.lockDatasets(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var version, active int
+	if err := tx.QueryRowContext(ctx, nextDatasetQuery).Scan(&version); err != nil {
+		return nil, err
+	}
+	if err := tx.QueryRowContext(ctx, activeDatasetQuery).Scan(&active); err != nil {
+		return nil, fmt.Errorf("looking up the active dataset failed, err: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, createDatasetQuery, version); err != nil {
+		return nil, err
+	}
+	// identifiers can't be parameterised, both are built from integers
+	table, from := datasetTable(version), datasetTable(active)
+	if _, err := tx.ExecContext(ctx, "CREATE TABLE "+table+" (LIKE "+from+" INCLUDING ALL)"); err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO "+table+" SELECT * FROM "+from); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return s.dataset(ctx, version)
+}
+
+// ActivateDataset marks a dataset ready (if it was loading), points the geolocation view at it
+// and drops the inactive datasets beyond retention, all in one transaction
+func (s *Connection) ActivateDataset(ctx context.Context, version int) error {
+	if s.closed {
+		return utils.ErrInvalidConn
+	}
+	tx, err := s.lockDatasets(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var status model.DatasetStatus
+	var active bool
+	if err := tx.QueryRowContext(ctx, datasetQuery, version).Scan(&status, &active); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("%w: %d", utils.ErrDatasetNotFound, version)
+		}
+		return err
+	}
+	if active {
+		return nil
+	}
+	table := datasetTable(version)
+	if status == model.DatasetLoading {
+		var locations int
+		if err := tx.QueryRowContext(ctx, "SELECT count(*) FROM "+table).Scan(&locations); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, readyDatasetQuery, version, locations); err != nil {
+			return err
+		}
+	}
+	// one at a time, the unique index allows a single active dataset at any point
+	if _, err := tx.ExecContext(ctx, deactivateQuery); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, activateQuery, version); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "CREATE OR REPLACE VIEW geolocation AS SELECT * FROM "+table); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DROP TABLE IF EXISTS "+presentTable(table)); err != nil {
+		return err
+	}
+	if err := s.prune(ctx, tx); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.statements.reset()
+	return nil
+}
+
+// DropDataset drops an inactive dataset along with its table
+func (s *Connection) DropDataset(ctx context.Context, version int) error {
+	if s.closed {
+		return utils.ErrInvalidConn
+	}
+	tx, err := s.lockDatasets(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var status model.DatasetStatus
+	var active bool
+	if err := tx.QueryRowContext(ctx, datasetQuery, version).Scan(&status, &active); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("%w: %d", utils.ErrDatasetNotFound, version)
+		}
+		return err
+	}
+	if active {
+		return fmt.Errorf("%w: %d", utils.ErrDatasetActive, version)
+	}
+	if err := dropDataset(ctx, tx, version); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.statements.reset()
+	return nil
+}
+
+// Datasets lists every dataset, oldest first
+func (s *Connection) Datasets(ctx context.Context) ([]model.Dataset, error) {
+	if s.closed {
+		return nil, utils.ErrInvalidConn
+	}
+	list, err := s.statements.prepare(ctx, datasetsQuery)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := list.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	datasets := []model.Dataset{}
+	for rows.Next() {
+		d := model.Dataset{}
+		if err := rows.Scan(&d.Version, &d.Status, &d.Locations, &d.Active, &d.CreatedAt, &d.ActivatedAt, &d.Resumable); err != nil {
+			return nil, err
+		}
+		datasets = append(datasets, d)
+	}
+	return datasets, rows.Err()
+}
+
+// dataset returns a single dataset
+func (s *Connection) dataset(ctx context.Context, version int) (*model.Dataset, error) {
+	datasets, err := s.Datasets(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range datasets {
+		if d.Version == version {
+			return &d, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %d", utils.ErrDatasetNotFound, version)
+}
+
+// datasetTableOf returns the table a write has to go to, resolving 0 to the active dataset
+func (s *Connection) datasetTableOf(ctx context.Context, tx *sqlx.Tx, version int) (string, error) {
+	if version != 0 {
+		return datasetTable(version), nil
+	}
+	if err := tx.QueryRowContext(ctx, activeDatasetQuery).Scan(&version); err != nil {
+		return "", fmt.Errorf("looking up the active dataset failed, err: %w", err)
+	}
+	return datasetTable(version), nil
+}
+
+// lockDatasets begins a transaction holding the dataset lifecycle lock
+func (s *Connection) lockDatasets(ctx context.Context) (*sqlx.Tx, error) {
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1)", datasetLockID); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return tx, nil
+}
+
+// prune drops the ready, inactive datasets beyond retention, newest ones are kept
+func (s *Connection) prune(ctx context.Context, tx *sqlx.Tx) error {
+	rows, err := tx.QueryContext(ctx, expiredQuery, s.retention)
+	if err != nil {
+		return err
+	}
+	expired := []int{}
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			rows.Close()
+			return err
+		}
+		expired = append(expired, version)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, version := range expired {
+		if err := dropDataset(ctx, tx, version); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func dropDataset(ctx context.Context, tx *sqlx.Tx, version int) error {
+	table := datasetTable(version)
+	if _, err := tx.ExecContext(ctx, "DROP TABLE IF EXISTS "+table+", "+presentTable(table)); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx, deleteDatasetQuery, version)
+	return err
+}
@@ -0,0 +1,261 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"geolocation/internal/model"
+	"geolocation/internal/utils"
+	"time"
+)
+
+// migration is a single versioned schema change, Up applies it & Down reverts it
+type migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// migrations lists every schema change in the order it has to be applied,
+// versions must be unique & ascending, an applied migration must never be edited
+var migrations = []migration{
+	{
+		Version: 1,
+		Name:    "create geolocation table",
+		Up: `CREATE TABLE IF NOT EXISTS geolocation (
+			ip_address 		varchar not null PRIMARY KEY,
+			country_code 	varchar not null,
+			country 		varchar not null,
+			city 			varchar not null,
+			latitude 		varchar not null,
+			longitude 		varchar not null,
+			mystery_value 	varchar not null)`,
+		Down: `DROP TABLE IF EXISTS geolocation`,
+	},
+	{
+		// a host row covers a /32 or /128, the gist index serves longest prefix match lookups
+		Version: 2,
+		Name:    "add ip_network to geolocation",
+		Up: `ALTER TABLE geolocation ADD COLUMN IF NOT EXISTS ip_network cidr;
+			UPDATE geolocation SET ip_network = ip_address::cidr WHERE ip_network IS NULL;
+			CREATE INDEX IF NOT EXISTS geolocation_ip_network_idx ON geolocation USING gist (ip_network inet_ops)`,
+		Down: `DROP INDEX IF EXISTS geolocation_ip_network_idx;
+			ALTER TABLE geolocation DROP COLUMN IF EXISTS ip_network`,
+	},
+	{
+		// empty mystery values become NULL (& empty again once reverted), any other value which isn't numeric
+		// (stored as is before sanitise checked it) fails the migration rather than getting lost
+		Version: 3,
+		Name:    "type geolocation columns",
+		Up: `DO $$
+			BEGIN
+				IF EXISTS (SELECT 1 FROM geolocation
+					WHERE mystery_value <> '' AND mystery_value !~ '^[+-]?([0-9]+(\.[0-9]*)?|\.[0-9]+)([eE][+-]?[0-9]+)?$') THEN
+					RAISE EXCEPTION 'geolocation holds non numeric mystery values, correct or empty them before migrating';
+				END IF;
+			END $$;
+			ALTER TABLE geolocation
+			ALTER COLUMN ip_address TYPE inet USING ip_address::inet,
+			ALTER COLUMN latitude TYPE double precision USING latitude::double precision,
+			ALTER COLUMN longitude TYPE double precision USING longitude::double precision,
+			ALTER COLUMN mystery_value DROP NOT NULL,
+			ALTER COLUMN mystery_value TYPE numeric USING CASE
+				WHEN mystery_value ~ '^[+-]?([0-9]+(\.[0-9]*)?|\.[0-9]+)([eE][+-]?[0-9]+)?$' THEN mystery_value::numeric
+			END`,
+		Down: `ALTER TABLE geolocation
+			ALTER COLUMN ip_address TYPE varchar USING abbrev(ip_address),
+			ALTER COLUMN latitude TYPE varchar USING latitude::varchar,
+			ALTER COLUMN longitude TYPE varchar USING longitude::varchar,
+			ALTER COLUMN mystery_value TYPE varchar USING coalesce(mystery_value::varchar, ''),
+			ALTER COLUMN mystery_value SET NOT NULL`,
+	},
+	{
+		// every dataset lives in its own geolocation_<version> table and the geolocation view
+		// always points at the active one, so readers never see a half loaded dataset
+		Version: 4,
+		Name:    "version geolocation datasets",
+		Up: `CREATE TABLE datasets (
+				version 		integer not null PRIMARY KEY,
+				status 			varchar not null,
+				locations 		bigint not null DEFAULT 0,
+				active 			boolean not null DEFAULT false,
+				created_at 		timestamptz not null DEFAULT now(),
+				activated_at 	timestamptz);
+			CREATE UNIQUE INDEX datasets_active_idx ON datasets (active) WHERE active;
+			ALTER TABLE geolocation RENAME TO geolocation_1;
+			INSERT INTO datasets (version, status, locations, active, activated_at) SELECT 1, 'ready', count(*), true, now() FROM geolocation_1;
+			CREATE VIEW geolocation AS SELECT * FROM geolocation_1`,
+		Down: `DROP VIEW geolocation;
+			DO $$
+			DECLARE d record;
+			BEGIN
+				FOR d IN SELECT version, active FROM datasets LOOP
+					-- left behind by a sync which never got to delete the absent locations
+					EXECUTE format('DROP TABLE IF EXISTS geolocation_%s_present', d.version);
+					IF d.active THEN
+						EXECUTE format('ALTER TABLE geolocation_%s RENAME TO geolocation', d.version);
+					ELSE
+						EXECUTE format('DROP TABLE IF EXISTS geolocation_%s', d.version);
+					END IF;
+				END LOOP;
+			END $$;
+			DROP TABLE datasets`,
+	},
+	{
+		// remote dumps are only downloaded again once their validators changed
+		Version: 5,
+		Name:    "create sources table",
+		Up: `CREATE TABLE sources (
+				url 			varchar not null PRIMARY KEY,
+				etag 			varchar not null,
+				last_modified 	varchar not null,
+				ingested_at 	timestamptz not null DEFAULT now())`,
+		Down: `DROP TABLE IF EXISTS sources`,
+	},
+	{
+		// a failed ingestion resumes after the last batch it committed
+		Version: 6,
+		Name:    "create checkpoints table",
+		Up: `CREATE TABLE checkpoints (
+				file 		varchar not null PRIMARY KEY,
+				run_id 		varchar not null,
+				checksum 	varchar not null,
+				dataset 	integer not null,
+				base 		integer not null,
+				line 		bigint not null,
+				byte_offset bigint not null,
+				updated_at 	timestamptz not null DEFAULT now())`,
+		Down: `DROP TABLE IF EXISTS checkpoints`,
+	},
+}
+
+const (
+	createMigrationsTableScript = `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version 	integer not null PRIMARY KEY,
+		name 		varchar not null,
+		applied_at 	timestamptz not null DEFAULT now())`
+
+	// migrationLockID is the advisory lock key serialising concurrent migrators
+	migrationLockID = 7366128
+)
+
+// latestMigration returns the version of the newest known migration
+func latestMigration() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// Migrate brings the schema up to the latest migration
+func (s *Connection) Migrate(ctx context.Context) error {
+	return s.MigrateTo(ctx, latestMigration())
+}
+
+// MigrateTo applies (or reverts) migrations until the schema is at the given version,
+// version 0 reverts every migration. Each migration runs in its own transaction
+func (s *Connection) MigrateTo(ctx context.Context, version int) error {
+	if s.closed {
+		return utils.ErrInvalidConn
+	}
+	if version < 0 || version > latestMigration() {
+		return fmt.Errorf("unknown migration version %d, latest is %d", version, latestMigration())
+	}
+	status, err := s.Migrations(ctx)
+	if err != nil {
+		return err
+	}
+	defer s.statements.reset()
+	for i, m := range migrations {
+		if m.Version <= version && status[i].AppliedAt == nil {
+			if err := s.apply(ctx, m, true); err != nil {
+				return err
+			}
+		}
+	}
+	for i := len(migrations) - 1; i >= 0; i-- {
+		if m := migrations[i]; m.Version > version && status[i].AppliedAt != nil {
+			if err := s.apply(ctx, m, false); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Migrations returns every known migration in order, applied ones carry the time they were applied at
+func (s *Connection) Migrations(ctx context.Context) ([]model.Migration, error) {
+	if s.closed {
+		return nil, utils.ErrInvalidConn
+	}
+	if _, err := s.db.ExecContext(ctx, createMigrationsTableScript); err != nil {
+		return nil, err
+	}
+	applied, err := s.statements.prepare(ctx, "SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	rows, err := applied.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	appliedAt := map[int]time.Time{}
+	for rows.Next() {
+		var version int
+		var at time.Time
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, err
+		}
+		appliedAt[version] = at
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	status := make([]model.Migration, 0, len(migrations))
+	for _, m := range migrations {
+		entry := model.Migration{Version: m.Version, Name: m.Name}
+		if at, ok := appliedAt[m.Version]; ok {
+			entry.AppliedAt = &at
+		}
+		status = append(status, entry)
+	}
+	return status, nil
+}
+
+// apply runs the up (or down) script of a migration & records it in schema_migrations
+func (s *Connection) apply(ctx context.Context, m migration, up bool) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// serialise concurrent migrators, then re-check the state under the lock
+	if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1)", migrationLockID); err != nil {
+		return err
+	}
+	var version int
+	err = tx.QueryRowContext(ctx, "SELECT version FROM schema_migrations WHERE version = $1", m.Version).Scan(&version)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if applied := err == nil; applied == up {
+		return tx.Commit()
+	}
+
+	script, record := m.Down, "DELETE FROM schema_migrations WHERE version = $1"
+	if up {
+		script, record = m.Up, "INSERT INTO schema_migrations (version, name) VALUES ($1, $2)"
+	}
+	if _, err := tx.ExecContext(ctx, script); err != nil {
+		return fmt.Errorf("migration %d (%s) failed, err: %w", m.Version, m.Name, err)
+	}
+	args := []interface{}{m.Version}
+	if up {
+		args = append(args, m.Name)
+	}
+	if _, err := tx.ExecContext(ctx, record, args...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,60 @@
+package database
+
+import (
+	"geolocation/internal/model"
+	"strings"
+)
+
+// insertQuery writes one batch of locations supplied as one array per column (see columns) into a dataset table,
+// it yields a single row counting the inserted & updated locations (see countWritten)
+func insertQuery(table string, policy model.ConflictPolicy) string {
+	return countWritten(`INSERT INTO ` + table + ` AS g (` + strings.Join(locationColumns, ", ") + `)
+		SELECT * FROM unnest($1::inet[], $2::cidr[], $3::varchar[], $4::varchar[], $5::varchar[], $6::float8[], $7::float8[], $8::numeric[])
+		` + onConflict(policy))
+}
+
+// mergeStagingQuery merges the staging table into a dataset table, see insertQuery
+func mergeStagingQuery(table string, policy model.ConflictPolicy) string {
+	columns := strings.Join(locationColumns, ", ")
+	return countWritten(`INSERT INTO ` + table + ` AS g (` + columns + `)
+		SELECT ` + columns + ` FROM ` + stagingTable + `
+		` + onConflict(policy))
+}
+
+// deleteAbsentQuery deletes the rows of a dataset table whose ip address isn't in its present table
+func deleteAbsentQuery(table string) string {
+	return `DELETE FROM ` + table + ` AS g
+		WHERE NOT EXISTS (SELECT 1 FROM ` + presentTable(table) + ` AS p WHERE p.ip_address = g.ip_address)`
+}
+
+// onConflict returns the ON CONFLICT clause of a policy,
+// update only rewrites rows whose data actually differs so identical rows count as skipped
+// and fail has no clause at all, so the unique key violation aborts the statement
+func onConflict(policy model.ConflictPolicy) string {
+	switch policy {
+	case model.ConflictUpdate:
+		updated := locationColumns[1:]
+		set := make([]string, 0, len(updated))
+		current := make([]string, 0, len(updated))
+		excluded := make([]string, 0, len(updated))
+		for _, column := range updated {
+			set = append(set, column+" = EXCLUDED."+column)
+			current = append(current, "g."+column)
+			excluded = append(excluded, "EXCLUDED."+column)
+		}
+		return `ON CONFLICT (ip_address) DO UPDATE SET ` + strings.Join(set, ", ") + `
+		WHERE (` + strings.Join(current, ", ") + `) IS DISTINCT FROM (` + strings.Join(excluded, ", ") + `)`
+	case model.ConflictFail:
+		return ""
+	default:
+		return `ON CONFLICT (ip_address) DO NOTHING`
+	}
+}
+
+// countWritten wraps an INSERT so it yields the number of inserted & updated rows,
+// a row updated in place has a non zero xmax whereas a freshly inserted one doesn't
+func countWritten(insert string) string {
+	return `WITH written AS (` + insert + `
+		RETURNING (xmax = 0) AS inserted)
+		SELECT count(*) FILTER (WHERE inserted), count(*) FILTER (WHERE NOT inserted) FROM written`
+}
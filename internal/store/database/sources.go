@@ -0,0 +1,53 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"geolocation/internal/model"
+	"geolocation/internal/utils"
+)
+
+const (
+	sourceQuery     = `SELECT url, etag, last_modified, ingested_at FROM sources WHERE url = $1`
+	saveSourceQuery = `INSERT INTO sources (url, etag, last_modified) VALUES ($1, $2, $3)
+		ON CONFLICT (url) DO UPDATE SET etag = EXCLUDED.etag, last_modified = EXCLUDED.last_modified, ingested_at = now()`
+)
+
+// Source returns the version of a remote dump ingested last
+func (s *Connection) Source(ctx context.Context, url string) (*model.Source, error) {
+	if s.closed {
+		return nil, utils.ErrInvalidConn
+	}
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	get, err := s.statements.prepare(ctx, sourceQuery)
+	if err != nil {
+		return nil, err
+	}
+	source := model.Source{}
+	if err := get.QueryRowContext(ctx, url).Scan(&source.URL, &source.ETag, &source.LastModified, &source.IngestedAt); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, utils.ErrNotFound
+		}
+		return nil, err
+	}
+	return &source, nil
+}
+
+// SaveSource records the version of a remote dump once ingested, replacing the previous one
+func (s *Connection) SaveSource(ctx context.Context, source model.Source) error {
+	if s.closed {
+		return utils.ErrInvalidConn
+	}
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	save, err := s.statements.prepare(ctx, saveSourceQuery)
+	if err != nil {
+		return err
+	}
+	_, err = save.ExecContext(ctx, source.URL, source.ETag, source.LastModified)
+	return err
+}
@@ -0,0 +1,63 @@
+package database
+
+import (
+	"context"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// statements caches prepared statements by kind for the lifetime of a Connection,
+// statements are prepared lazily as the tables they refer to may not exist before migrating
+type statements struct {
+	db    *sqlx.DB
+	mu    sync.Mutex
+	cache map[string]statement
+}
+
+// statement is a prepared statement along with its query
+type statement struct {
+	query string
+	stmt  *sqlx.Stmt
+}
+
+func newStatements(db *sqlx.DB) *statements {
+	return &statements{db: db, cache: map[string]statement{}}
+}
+
+// prepare returns the prepared statement of query, preparing it on first use
+func (s *statements) prepare(ctx context.Context, query string) (*sqlx.Stmt, error) {
+	return s.prepareAs(ctx, query, query)
+}
+
+// prepareAs returns the prepared statement of query cached as kind, preparing it on first use.
+// A query of the same kind but for another table (e.g. the next dataset) replaces & closes the cached one,
+// so the cache holds a single statement per kind however many datasets get loaded
+func (s *statements) prepareAs(ctx context.Context, kind, query string) (*sqlx.Stmt, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cached, ok := s.cache[kind]
+	if ok && cached.query == query {
+		return cached.stmt, nil
+	}
+	stmt, err := s.db.PreparexContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		cached.stmt.Close()
+	}
+	s.cache[kind] = statement{query, stmt}
+	return stmt, nil
+}
+
+// reset closes every prepared statement, they get re-prepared on next use.
+// Required whenever the schema changes as postgres refuses plans whose result types changed
+func (s *statements) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for kind, cached := range s.cache {
+		cached.stmt.Close()
+		delete(s.cache, kind)
+	}
+}
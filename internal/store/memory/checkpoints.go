@@ -0,0 +1,48 @@
+package memory
+
+import (
+	"context"
+	"geolocation/internal/model"
+	"geolocation/internal/utils"
+	"time"
+)
+
+// Checkpoint returns how far the last ingestion of a file got
+func (c *Connection) Checkpoint(ctx context.Context, file string) (*model.Checkpoint, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.closed {
+		return nil, utils.ErrInvalidConn
+	}
+	checkpoint, ok := c.checkpoints[file]
+	if !ok {
+		return nil, utils.ErrNotFound
+	}
+	return &checkpoint, nil
+}
+
+// SaveCheckpoint records how far the ingestion of a file got, replacing its previous checkpoint
+func (c *Connection) SaveCheckpoint(ctx context.Context, checkpoint model.Checkpoint) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return utils.ErrInvalidConn
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	checkpoint.UpdatedAt = time.Now()
+	c.checkpoints[checkpoint.File] = checkpoint
+	return nil
+}
+
+// DeleteCheckpoint forgets the checkpoint of a file
+func (c *Connection) DeleteCheckpoint(ctx context.Context, file string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return utils.ErrInvalidConn
+	}
+	delete(c.checkpoints, file)
+	return nil
+}
@@ -0,0 +1,304 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"geolocation/internal/model"
+	"geolocation/internal/utils"
+	"net"
+	"sync"
+)
+
+// Driver is the DB_DRIVER value selecting the in-memory store
+const Driver = "memory"
+
+// Connection is an in-memory store indexing every dataset in a radix tree by network,
+// optionally persisted to & loaded from a local snapshot file.
+// it is safe for concurrent use
+// implements internal.Store
+type Connection struct {
+	mu       sync.RWMutex
+	datasets map[int]*dataset
+	active   int
+	sources  map[string]model.Source
+	// checkpoints aren't persisted, as snapshots only hold ready datasets a failed ingestion can't be resumed after a restart
+	checkpoints map[string]model.Checkpoint
+	retention   int
+	snapshot    string
+	dirty       bool
+	closed      bool
+}
+
+// New creates new in-memory store holding a single empty active dataset,
+// or the datasets of the snapshot file if one is configured and present.
+// An empty snapshot path keeps the store purely in memory
+func New(cfg model.DB) (*Connection, error) {
+	retention := cfg.DatasetRetention
+	if retention <= 0 {
+		retention = utils.DefaultDatasetRetention
+	}
+	c := &Connection{retention: retention, snapshot: cfg.Snapshot, sources: map[string]model.Source{}, checkpoints: map[string]model.Checkpoint{}}
+	c.reset()
+	if c.snapshot != "" {
+		if err := c.load(); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Migrate has nothing to migrate for an in-memory store
+func (c *Connection) Migrate(ctx context.Context) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.closed {
+		return utils.ErrInvalidConn
+	}
+	return ctx.Err()
+}
+
+// BulkCreate indexes the locations into the dataset picked by opts.Dataset, locations whose network is already present
+// are skipped, updated or fail the whole call (leaving the store untouched) as per the conflict policy
+func (c *Connection) BulkCreate(ctx context.Context, locations []model.Location, opts model.WriteOptions) (model.WriteStat, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return model.WriteStat{}, utils.ErrInvalidConn
+	}
+	if err := ctx.Err(); err != nil {
+		return model.WriteStat{}, err
+	}
+	version := opts.Dataset
+	if version == 0 {
+		version = c.active
+	}
+	d, ok := c.datasets[version]
+	if !ok {
+		return model.WriteStat{}, fmt.Errorf("%w: %d", utils.ErrDatasetNotFound, version)
+	}
+	locations, duplicates := utils.DedupeLocations(locations, opts.OnConflict)
+	if duplicates > 0 && opts.OnConflict == model.ConflictFail {
+		return model.WriteStat{}, fmt.Errorf("%w: %d duplicate location(s) in the same write", utils.ErrConflict, duplicates)
+	}
+
+	entries := make([]entry, 0, len(locations))
+	for i := range locations {
+		e, err := newEntry(locations[i])
+		if err != nil {
+			return model.WriteStat{}, err
+		}
+		if opts.OnConflict == model.ConflictFail && d.tree.get(e.key, e.bits) != nil {
+			return model.WriteStat{}, fmt.Errorf("%w: %s", utils.ErrConflict, e.location.IPAddress)
+		}
+		entries = append(entries, e)
+	}
+
+	stat := model.WriteStat{Skipped: duplicates}
+	for _, e := range entries {
+		existing := d.tree.get(e.key, e.bits)
+		switch {
+		case existing == nil:
+			d.tree.insert(e.key, e.bits, e.location, false)
+			stat.Inserted++
+		case opts.OnConflict == model.ConflictUpdate && !utils.SameLocation(*existing, *e.location):
+			d.tree.insert(e.key, e.bits, e.location, true)
+			stat.Updated++
+		default:
+			stat.Skipped++
+		}
+	}
+	if version == c.active && stat.Inserted+stat.Updated > 0 {
+		c.dirty = true
+	}
+	return stat, nil
+}
+
+// MarkPresent records the networks of the locations as present in the dataset picked by opts.Dataset
+func (c *Connection) MarkPresent(ctx context.Context, locations []model.Location, opts model.WriteOptions) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return utils.ErrInvalidConn
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	version := opts.Dataset
+	if version == 0 {
+		version = c.active
+	}
+	d, ok := c.datasets[version]
+	if !ok {
+		return fmt.Errorf("%w: %d", utils.ErrDatasetNotFound, version)
+	}
+	if d.present == nil {
+		d.present = map[prefix]bool{}
+	}
+	for _, l := range locations {
+		key, bits, err := networkKey(l)
+		if err != nil {
+			return err
+		}
+		d.present[prefix{key, bits}] = true
+	}
+	return nil
+}
+
+// DeleteAbsent deletes every location of the dataset picked by opts.Dataset whose network wasn't marked present,
+// then forgets the marks
+func (c *Connection) DeleteAbsent(ctx context.Context, opts model.WriteOptions) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return 0, utils.ErrInvalidConn
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	version := opts.Dataset
+	if version == 0 {
+		version = c.active
+	}
+	d, ok := c.datasets[version]
+	if !ok {
+		return 0, fmt.Errorf("%w: %d", utils.ErrDatasetNotFound, version)
+	}
+
+	absent := []prefix{}
+	var err error
+	d.tree.walk(func(l *model.Location) bool {
+		var n prefix
+		if n.key, n.bits, err = networkKey(*l); err != nil {
+			return false
+		}
+		if !d.present[n] {
+			absent = append(absent, n)
+		}
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, n := range absent {
+		d.tree.remove(n.key, n.bits)
+	}
+	d.present = nil
+	if version == c.active && len(absent) > 0 {
+		c.dirty = true
+	}
+	return len(absent), nil
+}
+
+// Get returns the location of the most specific network containing the ip address
+func (c *Connection) Get(ctx context.Context, ipAddress string) (*model.Location, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.closed {
+		return nil, utils.ErrInvalidConn
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	valid, ipAddress := utils.IsIPValid(ipAddress)
+	if !valid {
+		return nil, utils.ErrBadRequest
+	}
+	match, _ := c.datasets[c.active].tree.lookup(ipKey(net.ParseIP(ipAddress)))
+	if match == nil {
+		return nil, utils.ErrNotFound
+	}
+	location := *match
+	location.IPAddress = ipAddress
+	return &location, nil
+}
+
+// GetMany returns the location of the most specific network containing each ip address, keyed by canonical ip address
+func (c *Connection) GetMany(ctx context.Context, ipAddresses []string) (map[string]*model.Location, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.closed {
+		return nil, utils.ErrInvalidConn
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	locations := make(map[string]*model.Location, len(ipAddresses))
+	for _, ipAddress := range ipAddresses {
+		valid, ipAddress := utils.IsIPValid(ipAddress)
+		if !valid {
+			return nil, utils.ErrBadRequest
+		}
+		if match, _ := c.datasets[c.active].tree.lookup(ipKey(net.ParseIP(ipAddress))); match != nil {
+			location := *match
+			location.IPAddress = ipAddress
+			locations[ipAddress] = &location
+		}
+	}
+	return locations, nil
+}
+
+// Close writes the snapshot file (if any served data changed) and releases every index
+func (c *Connection) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return utils.ErrInvalidConn
+	}
+	c.closed = true
+	var err error
+	if c.snapshot != "" && c.dirty {
+		err = c.save()
+	}
+	c.datasets = nil
+	return err
+}
+
+// ipKey converts an ip address to a tree key
+func ipKey(ip net.IP) [net.IPv6len]byte {
+	var key [net.IPv6len]byte
+	copy(key[:], ip.To16())
+	return key
+}
+
+// prefix is the tree key & prefix length of a network
+type prefix struct {
+	key  [net.IPv6len]byte
+	bits int
+}
+
+// entry is a location along with its tree key
+type entry struct {
+	key      [net.IPv6len]byte
+	bits     int
+	location *model.Location
+}
+
+// newEntry normalises the network of a location & computes its tree key
+func newEntry(location model.Location) (entry, error) {
+	key, bits, err := networkKey(location)
+	if err != nil {
+		return entry{}, err
+	}
+	if location.Network == "" {
+		location.Network = utils.HostNetwork(location.IPAddress)
+	}
+	return entry{key, bits, &location}, nil
+}
+
+// networkKey returns the tree key & prefix length of the network a location covers
+func networkKey(location model.Location) ([net.IPv6len]byte, int, error) {
+	network := location.Network
+	if network == "" {
+		network = utils.HostNetwork(location.IPAddress)
+	}
+	_, ipNet, err := net.ParseCIDR(network)
+	if err != nil {
+		return [net.IPv6len]byte{}, 0, errors.New("invalid network of ip: " + location.IPAddress + ", err: " + err.Error())
+	}
+	ones, bits := ipNet.Mask.Size()
+	if bits == 8*net.IPv4len {
+		ones += keyBits - bits
+	}
+	return ipKey(ipNet.IP), ones, nil
+}
@@ -0,0 +1,340 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"geolocation/internal/model"
+	"geolocation/internal/utils"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var locations = []model.Location{
+	{IPAddress: "200.0.0.0/8", Network: "200.0.0.0/8", CountryCode: "SI", Country: "Nepal", City: "DuBuquemouth", Latitude: -84.87503094689836, Longitude: 7.206435933364332, MysteryValue: "7823011346"},
+	{IPAddress: "200.106.0.0/16", Network: "200.106.0.0/16", CountryCode: "CZ", Country: "Nicaragua", City: "New Neva", Latitude: -68.31023296602508, Longitude: -37.62435199624531, MysteryValue: "7301823115"},
+	{IPAddress: "200.106.141.15", CountryCode: "TL", Country: "Saudi Arabia", City: "Gradymouth", Latitude: -49.16675918861615, Longitude: -86.05920084416894, MysteryValue: "2559997162"},
+	{IPAddress: "200.106.128.0/17", Network: "200.106.128.0/17", CountryCode: "PY", Country: "Falkland Islands (Malvinas)", City: "Port Karson", Latitude: 75.41685191518815, Longitude: -144.6943217219469, MysteryValue: "0"},
+	{IPAddress: "2001:db8::/32", Network: "2001:db8::/32", CountryCode: "LI", Country: "Guyana", City: "Port Karson", Latitude: -78.2274228596799, Longitude: -163.26218895343357, MysteryValue: "1337885276"},
+	{IPAddress: "2001:db8::68", CountryCode: "NL", Country: "Netherlands", City: "Amsterdam", Latitude: 52.3675734, Longitude: 4.9041389, MysteryValue: "1"},
+	{IPAddress: "70.95.73.73", CountryCode: "TL", Country: "Saudi Arabia", City: "Gradymouth", Latitude: -49.16675918861615, Longitude: -86.05920084416894},
+}
+
+func TestConnection_Get(t *testing.T) {
+	ctx := context.Background()
+	conn, err := New(model.DB{})
+	assert.Nil(t, err, "New() failed, expected no error, got %v", err)
+	_, err = conn.BulkCreate(ctx, locations, model.WriteOptions{})
+	assert.Nil(t, err, "BulkCreate() failed, expected no error, got %v", err)
+
+	tests := []struct {
+		name    string
+		ip      string
+		network string
+		wantErr error
+	}{
+		{name: "host row should win", ip: "200.106.141.15", network: "200.106.141.15/32"},
+		{name: "ipv4 mapped notation should match the host row", ip: "::ffff:200.106.141.15", network: "200.106.141.15/32"},
+		{name: "most specific network should win", ip: "200.106.141.16", network: "200.106.128.0/17"},
+		{name: "enclosing network should match outside the narrower one", ip: "200.106.1.1", network: "200.106.0.0/16"},
+		{name: "least specific network should match", ip: "200.1.2.3", network: "200.0.0.0/8"},
+		{name: "ipv6 host should win", ip: "2001:0db8::0068", network: "2001:db8::68/128"},
+		{name: "ipv6 network should match", ip: "2001:db8::69", network: "2001:db8::/32"},
+		{name: "unknown address should not be found", ip: "10.0.0.1", wantErr: utils.ErrNotFound},
+		{name: "invalid address should be rejected", ip: "200.106", wantErr: utils.ErrBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := conn.Get(ctx, tt.ip)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr, "expected error %v, got %v", tt.wantErr, err)
+				return
+			}
+			assert.Nil(t, err, "Get() failed, expected no error, got %v", err)
+			assert.Equal(t, tt.network, got.Network, "network must match, wanted %v, got %v", tt.network, got.Network)
+		})
+	}
+}
+
+func TestConnection_Snapshot(t *testing.T) {
+	ctx := context.Background()
+	snapshot := filepath.Join(t.TempDir(), "geolocation.snapshot")
+
+	conn, err := New(model.DB{Snapshot: snapshot})
+	assert.Nil(t, err, "New() failed, expected no error, got %v", err)
+	_, err = conn.BulkCreate(ctx, locations, model.WriteOptions{})
+	assert.Nil(t, err, "BulkCreate() failed, expected no error, got %v", err)
+	err = conn.Close()
+	assert.Nil(t, err, "Close() failed, expected no error, got %v", err)
+
+	_, err = conn.Get(ctx, "200.106.141.15")
+	assert.ErrorIs(t, err, utils.ErrInvalidConn, "expected error %v on closed connection, got %v", utils.ErrInvalidConn, err)
+
+	reloaded, err := New(model.DB{Snapshot: snapshot})
+	assert.Nil(t, err, "New() failed to load snapshot, expected no error, got %v", err)
+	defer reloaded.Close()
+	assert.Equal(t, len(locations), reloaded.datasets[reloaded.active].tree.size, "expected %d locations after reload, got %d", len(locations), reloaded.datasets[reloaded.active].tree.size)
+	for _, l := range locations {
+		ip := strings.Split(l.IPAddress, "/")[0]
+		got, err := reloaded.Get(ctx, ip)
+		assert.Nil(t, err, "Get(%s) failed after reload, expected no error, got %v", ip, err)
+		if err == nil {
+			assert.Equal(t, l.City, got.City, "city must match after reload, wanted %v, got %v", l.City, got.City)
+			assert.Equal(t, l.MysteryValue, got.MysteryValue, "mystery value must match after reload, wanted %v, got %v", l.MysteryValue, got.MysteryValue)
+		}
+	}
+}
+
+func TestConnection_Concurrent(t *testing.T) {
+	ctx := context.Background()
+	conn, err := New(model.DB{})
+	assert.Nil(t, err, "New() failed, expected no error, got %v", err)
+	defer conn.Close()
+
+	wg := sync.WaitGroup{}
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				ip := fmt.Sprintf("10.%d.%d.1", w, i)
+				_, err := conn.BulkCreate(ctx, []model.Location{{IPAddress: ip, MysteryValue: ""}}, model.WriteOptions{})
+				assert.Nil(t, err, "BulkCreate(%s) failed, expected no error, got %v", ip, err)
+				_, err = conn.Get(ctx, ip)
+				assert.Nil(t, err, "Get(%s) failed, expected no error, got %v", ip, err)
+			}
+		}(w)
+	}
+	wg.Wait()
+	assert.Equal(t, 800, conn.datasets[conn.active].tree.size, "expected 800 locations, got %d", conn.datasets[conn.active].tree.size)
+}
+
+func TestConnection_BulkCreateConflicts(t *testing.T) {
+	ctx := context.Background()
+	stale := model.Location{IPAddress: "200.106.141.15", CountryCode: "TL", Country: "Saudi Arabia", City: "Gradymouth", MysteryValue: "1"}
+	fresh := model.Location{IPAddress: "200.106.141.15", CountryCode: "TL", Country: "Saudi Arabia", City: "Port Karson", MysteryValue: "1"}
+	other := model.Location{IPAddress: "70.95.73.73", CountryCode: "SI", Country: "Nepal", City: "DuBuquemouth", MysteryValue: "2"}
+
+	tests := []struct {
+		name     string
+		policy   model.ConflictPolicy
+		write    []model.Location
+		stat     model.WriteStat
+		wantErr  error
+		wantCity string
+	}{
+		{
+			name:     "skip should keep the stored location",
+			policy:   model.ConflictSkip,
+			write:    []model.Location{fresh, other},
+			stat:     model.WriteStat{Inserted: 1, Skipped: 1},
+			wantCity: "Gradymouth",
+		},
+		{
+			name:     "update should overwrite the stored location",
+			policy:   model.ConflictUpdate,
+			write:    []model.Location{fresh, other},
+			stat:     model.WriteStat{Inserted: 1, Updated: 1},
+			wantCity: "Port Karson",
+		},
+		{
+			name:     "update should skip identical locations",
+			policy:   model.ConflictUpdate,
+			write:    []model.Location{stale, other},
+			stat:     model.WriteStat{Inserted: 1, Skipped: 1},
+			wantCity: "Gradymouth",
+		},
+		{
+			name:     "update should keep the last of duplicated locations",
+			policy:   model.ConflictUpdate,
+			write:    []model.Location{stale, fresh},
+			stat:     model.WriteStat{Updated: 1, Skipped: 1},
+			wantCity: "Port Karson",
+		},
+		{
+			name:     "fail should abort without writing anything",
+			policy:   model.ConflictFail,
+			write:    []model.Location{other, fresh},
+			wantErr:  utils.ErrConflict,
+			wantCity: "Gradymouth",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := New(model.DB{})
+			assert.Nil(t, err, "New() failed, expected no error, got %v", err)
+			defer conn.Close()
+			_, err = conn.BulkCreate(ctx, []model.Location{stale}, model.WriteOptions{})
+			assert.Nil(t, err, "BulkCreate() failed to seed, expected no error, got %v", err)
+
+			stat, err := conn.BulkCreate(ctx, tt.write, model.WriteOptions{OnConflict: tt.policy})
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr, "expected error %v, got %v", tt.wantErr, err)
+				_, err = conn.Get(ctx, other.IPAddress)
+				assert.ErrorIs(t, err, utils.ErrNotFound, "expected nothing to be written, got %v", err)
+			} else {
+				assert.Nil(t, err, "BulkCreate() failed, expected no error, got %v", err)
+				assert.Equal(t, tt.stat, stat, "expected write stat %#v, got %#v", tt.stat, stat)
+			}
+			got, err := conn.Get(ctx, stale.IPAddress)
+			assert.Nil(t, err, "Get() failed, expected no error, got %v", err)
+			assert.Equal(t, tt.wantCity, got.City, "city must match, wanted %v, got %v", tt.wantCity, got.City)
+		})
+	}
+}
+
+func TestConnection_GetMany(t *testing.T) {
+	ctx := context.Background()
+	conn, err := New(model.DB{})
+	assert.Nil(t, err, "New() failed, expected no error, got %v", err)
+	defer conn.Close()
+	_, err = conn.BulkCreate(ctx, locations, model.WriteOptions{})
+	assert.Nil(t, err, "BulkCreate() failed, expected no error, got %v", err)
+
+	got, err := conn.GetMany(ctx, []string{"::ffff:200.106.141.15", "200.106.1.1", "10.0.0.1", "2001:db8::69"})
+	assert.Nil(t, err, "GetMany() failed, expected no error, got %v", err)
+	assert.Equal(t, 3, len(got), "expected 3 resolved ip addresses, got %d", len(got))
+	assert.Equal(t, "200.106.141.15/32", got["200.106.141.15"].Network, "expected host network, got %v", got["200.106.141.15"].Network)
+	assert.Equal(t, "200.106.0.0/16", got["200.106.1.1"].Network, "expected enclosing network, got %v", got["200.106.1.1"].Network)
+	assert.Equal(t, "2001:db8::/32", got["2001:db8::69"].Network, "expected ipv6 network, got %v", got["2001:db8::69"].Network)
+	assert.Nil(t, got["10.0.0.1"], "expected unknown ip address to be left out, got %#v", got["10.0.0.1"])
+
+	_, err = conn.GetMany(ctx, []string{"200.106"})
+	assert.ErrorIs(t, err, utils.ErrBadRequest, "expected error %v, got %v", utils.ErrBadRequest, err)
+}
+
+func TestConnection_Datasets(t *testing.T) {
+	ctx := context.Background()
+	snapshot := filepath.Join(t.TempDir(), "geolocation.snapshot")
+	conn, err := New(model.DB{Snapshot: snapshot, DatasetRetention: 1})
+	assert.Nil(t, err, "New() failed, expected no error, got %v", err)
+
+	// a loading dataset must not be served before it gets activated
+	loading, err := conn.CreateDataset(ctx)
+	assert.Nil(t, err, "CreateDataset() failed, expected no error, got %v", err)
+	_, err = conn.BulkCreate(ctx, locations, model.WriteOptions{Dataset: loading.Version})
+	assert.Nil(t, err, "BulkCreate() failed, expected no error, got %v", err)
+	_, err = conn.Get(ctx, "70.95.73.73")
+	assert.ErrorIs(t, err, utils.ErrNotFound, "expected error %v before activation, got %v", utils.ErrNotFound, err)
+	err = conn.ActivateDataset(ctx, loading.Version)
+	assert.Nil(t, err, "ActivateDataset() failed, expected no error, got %v", err)
+	_, err = conn.Get(ctx, "70.95.73.73")
+	assert.Nil(t, err, "Get() failed after activation, expected no error, got %v", err)
+
+	// the active dataset can't be dropped, a newer one is a copy of it
+	err = conn.DropDataset(ctx, loading.Version)
+	assert.ErrorIs(t, err, utils.ErrDatasetActive, "expected error %v, got %v", utils.ErrDatasetActive, err)
+	next, err := conn.CreateDataset(ctx)
+	assert.Nil(t, err, "CreateDataset() failed, expected no error, got %v", err)
+	_, err = conn.BulkCreate(ctx, []model.Location{{IPAddress: "10.0.0.1", Network: "10.0.0.1/32", CountryCode: "NL", Country: "Netherlands", City: "Amsterdam"}}, model.WriteOptions{Dataset: next.Version})
+	assert.Nil(t, err, "BulkCreate() failed, expected no error, got %v", err)
+	err = conn.ActivateDataset(ctx, next.Version)
+	assert.Nil(t, err, "ActivateDataset() failed, expected no error, got %v", err)
+
+	// only one inactive dataset is retained
+	datasets, err := conn.Datasets(ctx)
+	assert.Nil(t, err, "Datasets() failed, expected no error, got %v", err)
+	assert.Equal(t, 2, len(datasets), "expected 2 datasets, got %#v", datasets)
+	assert.Equal(t, loading.Version, datasets[0].Version, "expected dataset %d to be retained, got %#v", loading.Version, datasets)
+	assert.Equal(t, len(locations), datasets[0].Locations, "expected %d locations, got %d", len(locations), datasets[0].Locations)
+	assert.True(t, datasets[1].Active, "expected dataset %d to be active, got %#v", next.Version, datasets[1])
+	assert.Equal(t, len(locations)+1, datasets[1].Locations, "expected %d locations, got %d", len(locations)+1, datasets[1].Locations)
+
+	// rolling back survives a snapshot round trip
+	err = conn.ActivateDataset(ctx, loading.Version)
+	assert.Nil(t, err, "ActivateDataset() failed, expected no error, got %v", err)
+	err = conn.Close()
+	assert.Nil(t, err, "Close() failed, expected no error, got %v", err)
+	reloaded, err := New(model.DB{Snapshot: snapshot, DatasetRetention: 1})
+	assert.Nil(t, err, "New() failed to load snapshot, expected no error, got %v", err)
+	defer reloaded.Close()
+	assert.Equal(t, loading.Version, reloaded.active, "expected dataset %d to be active after reload, got %d", loading.Version, reloaded.active)
+	_, err = reloaded.Get(ctx, "10.0.0.1")
+	assert.ErrorIs(t, err, utils.ErrNotFound, "expected error %v after rollback, got %v", utils.ErrNotFound, err)
+	err = reloaded.ActivateDataset(ctx, next.Version)
+	assert.Nil(t, err, "ActivateDataset() failed after reload, expected no error, got %v", err)
+	_, err = reloaded.Get(ctx, "10.0.0.1")
+	assert.Nil(t, err, "Get() failed after reload, expected no error, got %v", err)
+}
+
+func TestConnection_Sources(t *testing.T) {
+	ctx := context.Background()
+	snapshot := filepath.Join(t.TempDir(), "geolocation.snapshot")
+
+	conn, err := New(model.DB{Snapshot: snapshot})
+	assert.Nil(t, err, "New() failed, expected no error, got %v", err)
+	_, err = conn.Source(ctx, "https://example.com/dump.csv")
+	assert.ErrorIs(t, err, utils.ErrNotFound, "expected error %v for an unknown source, got %v", utils.ErrNotFound, err)
+	err = conn.SaveSource(ctx, model.Source{URL: "https://example.com/dump.csv", ETag: `"v1"`})
+	assert.Nil(t, err, "SaveSource() failed, expected no error, got %v", err)
+	err = conn.SaveSource(ctx, model.Source{URL: "https://example.com/dump.csv", ETag: `"v2"`})
+	assert.Nil(t, err, "SaveSource() failed, expected no error, got %v", err)
+	err = conn.Close()
+	assert.Nil(t, err, "Close() failed, expected no error, got %v", err)
+
+	reloaded, err := New(model.DB{Snapshot: snapshot})
+	assert.Nil(t, err, "New() failed to load snapshot, expected no error, got %v", err)
+	defer reloaded.Close()
+	source, err := reloaded.Source(ctx, "https://example.com/dump.csv")
+	assert.Nil(t, err, "Source() failed after reload, expected no error, got %v", err)
+	assert.Equal(t, `"v2"`, source.ETag, "the latest version of a source must be kept, wanted %v, got %v", `"v2"`, source.ETag)
+}
+
+func TestConnection_DeleteAbsent(t *testing.T) {
+	ctx := context.Background()
+	conn, err := New(model.DB{})
+	assert.Nil(t, err, "New() failed, expected no error, got %v", err)
+	defer conn.Close()
+	_, err = conn.BulkCreate(ctx, locations, model.WriteOptions{})
+	assert.Nil(t, err, "BulkCreate() failed, expected no error, got %v", err)
+	dataset, err := conn.CreateDataset(ctx)
+	assert.Nil(t, err, "CreateDataset() failed, expected no error, got %v", err)
+
+	// the /16 network & the ipv6 host are absent, their enclosing networks are kept, marks add up
+	present := []model.Location{locations[0], locations[2], locations[3], locations[4], locations[6]}
+	for _, marked := range [][]model.Location{present[:2], present[2:]} {
+		err = conn.MarkPresent(ctx, marked, model.WriteOptions{Dataset: dataset.Version})
+		assert.Nil(t, err, "MarkPresent() failed, expected no error, got %v", err)
+	}
+	deleted, err := conn.DeleteAbsent(ctx, model.WriteOptions{Dataset: dataset.Version})
+	assert.Nil(t, err, "DeleteAbsent() failed, expected no error, got %v", err)
+	assert.Equal(t, 2, deleted, "expected 2 deleted locations, got %d", deleted)
+	err = conn.MarkPresent(ctx, present, model.WriteOptions{Dataset: dataset.Version})
+	assert.Nil(t, err, "MarkPresent() failed, expected no error, got %v", err)
+	deleted, err = conn.DeleteAbsent(ctx, model.WriteOptions{Dataset: dataset.Version})
+	assert.Nil(t, err, "DeleteAbsent() failed, expected no error, got %v", err)
+	assert.Zero(t, deleted, "expected nothing left to delete, got %d", deleted)
+
+	// the active dataset is left untouched until the synced one gets activated
+	got, err := conn.Get(ctx, "200.106.1.1")
+	assert.Nil(t, err, "Get() failed, expected no error, got %v", err)
+	assert.Equal(t, "200.106.0.0/16", got.Network, "expected the active dataset untouched, got %v", got.Network)
+	err = conn.ActivateDataset(ctx, dataset.Version)
+	assert.Nil(t, err, "ActivateDataset() failed, expected no error, got %v", err)
+	datasets, err := conn.Datasets(ctx)
+	assert.Nil(t, err, "Datasets() failed, expected no error, got %v", err)
+	assert.Equal(t, len(present), datasets[len(datasets)-1].Locations, "expected %d locations, got %d", len(present), datasets[len(datasets)-1].Locations)
+
+	tests := []struct {
+		ip      string
+		network string
+	}{
+		{ip: "200.106.1.1", network: "200.0.0.0/8"},
+		{ip: "200.106.141.15", network: "200.106.141.15/32"},
+		{ip: "200.106.200.1", network: "200.106.128.0/17"},
+		{ip: "2001:db8::68", network: "2001:db8::/32"},
+	}
+	for _, tt := range tests {
+		got, err := conn.Get(ctx, tt.ip)
+		assert.Nil(t, err, "Get(%s) failed, expected no error, got %v", tt.ip, err)
+		assert.Equal(t, tt.network, got.Network, "Get(%s) must match the enclosing network, wanted %v, got %v", tt.ip, tt.network, got.Network)
+	}
+
+	// an absent location can be inserted again
+	stat, err := conn.BulkCreate(ctx, locations[1:2], model.WriteOptions{})
+	assert.Nil(t, err, "BulkCreate() failed, expected no error, got %v", err)
+	assert.Equal(t, 1, stat.Inserted, "expected 1 inserted location, got %d", stat.Inserted)
+}
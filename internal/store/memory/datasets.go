@@ -0,0 +1,151 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"geolocation/internal/model"
+	"geolocation/internal/utils"
+	"sort"
+	"time"
+)
+
+// dataset is one version of the location data along with its index
+type dataset struct {
+	info model.Dataset
+	tree *tree
+	// present are the networks of a synced dump marked present, till the absent ones get deleted
+	present map[prefix]bool
+}
+
+// reset leaves the store with a single, empty & active dataset
+func (c *Connection) reset() {
+	now := time.Now()
+	c.datasets = map[int]*dataset{
+		1: {
+			info: model.Dataset{Version: 1, Status: model.DatasetReady, Active: true, CreatedAt: now, ActivatedAt: &now},
+			tree: &tree{},
+		},
+	}
+	c.active = 1
+}
+
+// CreateDataset creates a new loading dataset as a copy of the active one,
+// cloning its whole tree (the locations themselves are shared)
+func (c *Connection) CreateDataset(ctx context.Context) (*model.Dataset, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, utils.ErrInvalidConn
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	version := 0
+	for v := range c.datasets {
+		if v > version {
+			version = v
+		}
+	}
+	version++
+	d := &dataset{
+		info: model.Dataset{Version: version, Status: model.DatasetLoading, CreatedAt: time.Now()},
+		tree: c.datasets[c.active].tree.clone(),
+	}
+	c.datasets[version] = d
+	info := d.info
+	return &info, nil
+}
+
+// ActivateDataset marks a dataset ready (if it was loading), serves it from now on
+// and drops the inactive datasets beyond retention
+func (c *Connection) ActivateDataset(ctx context.Context, version int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return utils.ErrInvalidConn
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	d, ok := c.datasets[version]
+	if !ok {
+		return fmt.Errorf("%w: %d", utils.ErrDatasetNotFound, version)
+	}
+	if version == c.active {
+		return nil
+	}
+	if d.info.Status == model.DatasetLoading {
+		d.info.Status = model.DatasetReady
+		d.info.Locations = d.tree.size
+	}
+	now := time.Now()
+	c.datasets[c.active].info.Active = false
+	d.info.Active = true
+	d.info.ActivatedAt = &now
+	c.active = version
+	c.dirty = true
+	c.prune()
+	return nil
+}
+
+// DropDataset drops an inactive dataset
+func (c *Connection) DropDataset(ctx context.Context, version int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return utils.ErrInvalidConn
+	}
+	if _, ok := c.datasets[version]; !ok {
+		return fmt.Errorf("%w: %d", utils.ErrDatasetNotFound, version)
+	}
+	if version == c.active {
+		return fmt.Errorf("%w: %d", utils.ErrDatasetActive, version)
+	}
+	if c.datasets[version].info.Status == model.DatasetReady {
+		c.dirty = true
+	}
+	delete(c.datasets, version)
+	return nil
+}
+
+// Datasets lists every dataset, oldest first
+func (c *Connection) Datasets(ctx context.Context) ([]model.Dataset, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.closed {
+		return nil, utils.ErrInvalidConn
+	}
+	resumable := map[int]string{}
+	for _, checkpoint := range c.checkpoints {
+		resumable[checkpoint.Dataset] = checkpoint.File
+	}
+	datasets := make([]model.Dataset, 0, len(c.datasets))
+	for _, d := range c.datasets {
+		info := d.info
+		if info.Active {
+			info.Locations = d.tree.size
+		}
+		if info.Status == model.DatasetLoading {
+			info.Resumable = resumable[info.Version]
+		}
+		datasets = append(datasets, info)
+	}
+	sort.Slice(datasets, func(i, j int) bool { return datasets[i].Version < datasets[j].Version })
+	return datasets, nil
+}
+
+// prune drops the ready, inactive datasets beyond retention, newest ones are kept
+func (c *Connection) prune() {
+	inactive := []int{}
+	for v, d := range c.datasets {
+		if !d.info.Active && d.info.Status == model.DatasetReady {
+			inactive = append(inactive, v)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(inactive)))
+	for i, v := range inactive {
+		if i >= c.retention {
+			delete(c.datasets, v)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package memory
+
+import (
+	"bufio"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"geolocation/internal/model"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// snapshotVersion is bumped whenever the snapshot layout changes,
+// version 1 held a single dataset, version 2 holds every ready dataset
+const snapshotVersion = 2
+
+// snapshotHeader leads every snapshot file, followed by the locations of each dataset in header order,
+// one gob encoded model.Location per entry (version 1 only carried Count, for its single dataset).
+// Sources were added to version 2 later on, older snapshots simply lack them
+type snapshotHeader struct {
+	Version  int
+	Count    int
+	Active   int
+	Datasets []snapshotDataset
+	Sources  []model.Source
+}
+
+type snapshotDataset struct {
+	Info  model.Dataset
+	Count int
+}
+
+// load reads the snapshot file into the datasets, a missing file leaves the store as is
+func (c *Connection) load() error {
+	f, err := os.Open(c.snapshot)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	dec := gob.NewDecoder(bufio.NewReader(f))
+	header := snapshotHeader{}
+	if err := dec.Decode(&header); err != nil {
+		return fmt.Errorf("reading snapshot %s failed, err: %w", c.snapshot, err)
+	}
+	switch header.Version {
+	case 1:
+		return c.decodeDataset(dec, c.datasets[c.active], header.Count)
+	case snapshotVersion:
+	default:
+		return fmt.Errorf("unsupported snapshot version %d in %s", header.Version, c.snapshot)
+	}
+
+	for _, source := range header.Sources {
+		c.sources[source.URL] = source
+	}
+	c.datasets = make(map[int]*dataset, len(header.Datasets))
+	c.active = header.Active
+	for _, sd := range header.Datasets {
+		d := &dataset{info: sd.Info, tree: &tree{}}
+		if err := c.decodeDataset(dec, d, sd.Count); err != nil {
+			return err
+		}
+		c.datasets[sd.Info.Version] = d
+	}
+	if _, ok := c.datasets[c.active]; !ok {
+		return fmt.Errorf("snapshot %s misses its active dataset %d", c.snapshot, c.active)
+	}
+	return nil
+}
+
+func (c *Connection) decodeDataset(dec *gob.Decoder, d *dataset, count int) error {
+	for i := 0; i < count; i++ {
+		location := model.Location{}
+		if err := dec.Decode(&location); err != nil {
+			return fmt.Errorf("reading snapshot %s failed at entry %d of dataset %d, err: %w", c.snapshot, i, d.info.Version, err)
+		}
+		key, bits, err := networkKey(location)
+		if err != nil {
+			return err
+		}
+		d.tree.insert(key, bits, &location, true)
+	}
+	return nil
+}
+
+// save atomically replaces the snapshot file with every ready dataset
+func (c *Connection) save() error {
+	tmp, err := os.CreateTemp(filepath.Dir(c.snapshot), filepath.Base(c.snapshot)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := c.encode(tmp); err != nil {
+		tmp.Close()
+		return fmt.Errorf("writing snapshot %s failed, err: %w", c.snapshot, err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), c.snapshot); err != nil {
+		return err
+	}
+	c.dirty = false
+	return nil
+}
+
+func (c *Connection) encode(w io.Writer) error {
+	header := snapshotHeader{Version: snapshotVersion, Active: c.active}
+	datasets := []*dataset{}
+	for _, d := range c.datasets {
+		if d.info.Status == model.DatasetReady {
+			datasets = append(datasets, d)
+		}
+	}
+	sort.Slice(datasets, func(i, j int) bool { return datasets[i].info.Version < datasets[j].info.Version })
+	for _, d := range datasets {
+		header.Datasets = append(header.Datasets, snapshotDataset{Info: d.info, Count: d.tree.size})
+	}
+	for _, source := range c.sources {
+		header.Sources = append(header.Sources, source)
+	}
+	sort.Slice(header.Sources, func(i, j int) bool { return header.Sources[i].URL < header.Sources[j].URL })
+
+	buf := bufio.NewWriter(w)
+	enc := gob.NewEncoder(buf)
+	if err := enc.Encode(header); err != nil {
+		return err
+	}
+	for _, d := range datasets {
+		var err error
+		d.tree.walk(func(location *model.Location) bool {
+			err = enc.Encode(location)
+			return err == nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return buf.Flush()
+}
@@ -0,0 +1,38 @@
+package memory
+
+import (
+	"context"
+	"geolocation/internal/model"
+	"geolocation/internal/utils"
+	"time"
+)
+
+// Source returns the version of a remote dump ingested last
+func (c *Connection) Source(ctx context.Context, url string) (*model.Source, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.closed {
+		return nil, utils.ErrInvalidConn
+	}
+	source, ok := c.sources[url]
+	if !ok {
+		return nil, utils.ErrNotFound
+	}
+	return &source, nil
+}
+
+// SaveSource records the version of a remote dump once ingested, replacing the previous one
+func (c *Connection) SaveSource(ctx context.Context, source model.Source) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return utils.ErrInvalidConn
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	source.IngestedAt = time.Now()
+	c.sources[source.URL] = source
+	c.dirty = true
+	return nil
+}
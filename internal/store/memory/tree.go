@@ -0,0 +1,202 @@
+package memory
+
+import (
+	"geolocation/internal/model"
+	"net"
+)
+
+// keyBits is the width of every key in the tree,
+// IPv4 addresses are stored as IPv4-mapped IPv6 addresses (::ffff:0:0/96)
+const keyBits = 8 * net.IPv6len
+
+// node is a path compressed (patricia) node of the tree,
+// nodes without a location only exist to branch
+type node struct {
+	key      [net.IPv6len]byte
+	bits     int
+	location *model.Location
+	children [2]*node
+}
+
+// tree is a binary radix (patricia) tree over IP networks supporting longest prefix matching
+// it is not safe for concurrent use, callers are expected to synchronise access
+type tree struct {
+	root *node
+	size int
+}
+
+// insert stores the location against the network, returns false if the network is already present
+// in which case the existing location is replaced only if replace is set
+func (t *tree) insert(key [net.IPv6len]byte, bits int, location *model.Location, replace bool) bool {
+	n := &t.root
+	for {
+		cur := *n
+		if cur == nil {
+			*n = &node{key: key, bits: bits, location: location}
+			t.size++
+			return true
+		}
+		common := commonPrefixLen(cur.key, key, minInt(cur.bits, bits))
+		if common == cur.bits {
+			if cur.bits == bits {
+				if cur.location == nil {
+					cur.location = location
+					t.size++
+					return true
+				}
+				if replace {
+					cur.location = location
+				}
+				return false
+			}
+			n = &cur.children[bitAt(key, cur.bits)]
+			continue
+		}
+		if common == bits {
+			// the new network encloses the current node
+			parent := &node{key: key, bits: bits, location: location}
+			parent.children[bitAt(cur.key, bits)] = cur
+			*n = parent
+			t.size++
+			return true
+		}
+		// the new network diverges from the current node, branch at the common prefix
+		branch := &node{key: maskKey(key, common), bits: common}
+		branch.children[bitAt(cur.key, common)] = cur
+		branch.children[bitAt(key, common)] = &node{key: key, bits: bits, location: location}
+		*n = branch
+		t.size++
+		return true
+	}
+}
+
+// get returns the location stored against exactly the network, if any
+func (t *tree) get(key [net.IPv6len]byte, bits int) *model.Location {
+	for n := t.root; n != nil && n.bits <= bits; {
+		if commonPrefixLen(n.key, key, n.bits) < n.bits {
+			return nil
+		}
+		if n.bits == bits {
+			return n.location
+		}
+		n = n.children[bitAt(key, n.bits)]
+	}
+	return nil
+}
+
+// remove deletes the location stored against exactly the network, if any,
+// its node is left in place to branch
+func (t *tree) remove(key [net.IPv6len]byte, bits int) bool {
+	for n := t.root; n != nil && n.bits <= bits; {
+		if commonPrefixLen(n.key, key, n.bits) < n.bits {
+			return false
+		}
+		if n.bits == bits {
+			if n.location == nil {
+				return false
+			}
+			n.location = nil
+			t.size--
+			return true
+		}
+		n = n.children[bitAt(key, n.bits)]
+	}
+	return false
+}
+
+// lookup returns the location of the most specific network containing the ip
+func (t *tree) lookup(ip [net.IPv6len]byte) (*model.Location, int) {
+	var best *node
+	for n := t.root; n != nil; {
+		if commonPrefixLen(n.key, ip, n.bits) < n.bits {
+			break
+		}
+		if n.location != nil {
+			best = n
+		}
+		if n.bits == keyBits {
+			break
+		}
+		n = n.children[bitAt(ip, n.bits)]
+	}
+	if best == nil {
+		return nil, 0
+	}
+	return best.location, best.bits
+}
+
+// walk visits every location in key order, stops as soon as fn returns false
+func (t *tree) walk(fn func(location *model.Location) bool) {
+	var visit func(n *node) bool
+	visit = func(n *node) bool {
+		if n == nil {
+			return true
+		}
+		if n.location != nil && !fn(n.location) {
+			return false
+		}
+		return visit(n.children[0]) && visit(n.children[1])
+	}
+	visit(t.root)
+}
+
+// clone returns a copy of the tree sharing the (never mutated) locations
+func (t *tree) clone() *tree {
+	var copyNode func(n *node) *node
+	copyNode = func(n *node) *node {
+		if n == nil {
+			return nil
+		}
+		c := *n
+		c.children = [2]*node{copyNode(n.children[0]), copyNode(n.children[1])}
+		return &c
+	}
+	return &tree{root: copyNode(t.root), size: t.size}
+}
+
+// commonPrefixLen returns the number of leading bits (up to max) shared by a & b
+func commonPrefixLen(a, b [net.IPv6len]byte, max int) int {
+	n := 0
+	for i := 0; i < net.IPv6len && n < max; i++ {
+		x := a[i] ^ b[i]
+		if x == 0 {
+			n += 8
+			continue
+		}
+		for x&0x80 == 0 {
+			n++
+			x <<= 1
+		}
+		break
+	}
+	if n > max {
+		return max
+	}
+	return n
+}
+
+// bitAt returns the bit of key at position i (0 being the most significant bit)
+func bitAt(key [net.IPv6len]byte, i int) int {
+	return int(key[i/8]>>(7-uint(i%8))) & 1
+}
+
+// maskKey zeroes every bit of key after the first bits
+func maskKey(key [net.IPv6len]byte, bits int) [net.IPv6len]byte {
+	for i := 0; i < net.IPv6len; i++ {
+		switch {
+		case bits >= 8*(i+1):
+		case bits <= 8*i:
+			key[i] = 0
+		default:
+			key[i] &= ^byte(0xff >> uint(bits-8*i))
+		}
+	}
+	return key
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
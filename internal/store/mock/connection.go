@@ -2,23 +2,35 @@ package mock
 
 import (
 	"context"
+	"errors"
 	"geolocation/internal/model"
 	"geolocation/internal/utils"
+	"net"
+	"sort"
+	"sync"
 )
 
 // Connection mocks the phycial database connection with in-memory store
 // implements internal.Store
 type Connection struct {
-	locations []model.Location
-	closed    bool
+	mu          sync.Mutex
+	datasets    map[int][]model.Location
+	loading     map[int]bool
+	present     map[int]map[string]bool
+	active      int
+	sources     map[string]model.Source
+	checkpoints map[string]model.Checkpoint
+	closed      bool
 }
 
 // New creates new in-memory datastore
 func New() (*Connection, error) {
-	return &Connection{locations: []model.Location{}, closed: false}, nil
+	return &Connection{datasets: map[int][]model.Location{1: {}}, loading: map[int]bool{}, present: map[int]map[string]bool{}, active: 1, sources: map[string]model.Source{}, checkpoints: map[string]model.Checkpoint{}, closed: false}, nil
 }
 
 func (s *Connection) Migrate(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	if s.closed {
 		return utils.ErrInvalidConn
 	}
@@ -30,7 +42,64 @@ func (s *Connection) Migrate(ctx context.Context) error {
 	return nil
 }
 
-func (s *Connection) BulkCreate(ctx context.Context, locations []model.Location) error {
+func (s *Connection) BulkCreate(ctx context.Context, locations []model.Location, opts model.WriteOptions) (model.WriteStat, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return model.WriteStat{}, utils.ErrInvalidConn
+	}
+	select {
+	case <-ctx.Done():
+		return model.WriteStat{}, ctx.Err()
+	default:
+	}
+	version := opts.Dataset
+	if version == 0 {
+		version = s.active
+	}
+	stored, ok := s.datasets[version]
+	if !ok {
+		return model.WriteStat{}, utils.ErrDatasetNotFound
+	}
+	locations, duplicates := utils.DedupeLocations(locations, opts.OnConflict)
+	if duplicates > 0 && opts.OnConflict == model.ConflictFail {
+		return model.WriteStat{}, utils.ErrConflict
+	}
+	// rows are keyed by network, the way the real stores key them
+	index := make(map[string]int, len(stored))
+	for i, l := range stored {
+		index[utils.NetworkOf(l)] = i
+	}
+	if opts.OnConflict == model.ConflictFail {
+		for _, l := range locations {
+			if _, ok := index[utils.NetworkOf(l)]; ok {
+				return model.WriteStat{}, utils.ErrConflict
+			}
+		}
+	}
+	stat := model.WriteStat{Skipped: duplicates}
+	for _, l := range locations {
+		i, ok := index[utils.NetworkOf(l)]
+		switch {
+		case !ok:
+			index[utils.NetworkOf(l)] = len(stored)
+			stored = append(stored, l)
+			stat.Inserted++
+		case opts.OnConflict == model.ConflictUpdate && !utils.SameLocation(stored[i], l):
+			stored[i] = l
+			stat.Updated++
+		default:
+			stat.Skipped++
+		}
+	}
+	s.datasets[version] = stored
+	return stat, nil
+}
+
+// MarkPresent records the networks of the locations as present in the dataset picked by opts.Dataset
+func (s *Connection) MarkPresent(ctx context.Context, locations []model.Location, opts model.WriteOptions) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	if s.closed {
 		return utils.ErrInvalidConn
 	}
@@ -39,11 +108,58 @@ func (s *Connection) BulkCreate(ctx context.Context, locations []model.Location)
 		return ctx.Err()
 	default:
 	}
-	s.locations = locations
+	version := opts.Dataset
+	if version == 0 {
+		version = s.active
+	}
+	if _, ok := s.datasets[version]; !ok {
+		return utils.ErrDatasetNotFound
+	}
+	if s.present[version] == nil {
+		s.present[version] = map[string]bool{}
+	}
+	for _, l := range locations {
+		s.present[version][utils.NetworkOf(l)] = true
+	}
 	return nil
 }
 
+// DeleteAbsent deletes every location of the dataset picked by opts.Dataset whose network wasn't marked present,
+// then forgets the marks
+func (s *Connection) DeleteAbsent(ctx context.Context, opts model.WriteOptions) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return 0, utils.ErrInvalidConn
+	}
+	select {
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	default:
+	}
+	version := opts.Dataset
+	if version == 0 {
+		version = s.active
+	}
+	stored, ok := s.datasets[version]
+	if !ok {
+		return 0, utils.ErrDatasetNotFound
+	}
+	kept := make([]model.Location, 0, len(stored))
+	for _, l := range stored {
+		if s.present[version][utils.NetworkOf(l)] {
+			kept = append(kept, l)
+		}
+	}
+	s.datasets[version] = kept
+	delete(s.present, version)
+	return len(stored) - len(kept), nil
+}
+
+// Get returns the location of the most specific network containing the ip address
 func (s *Connection) Get(ctx context.Context, ipAddress string) (*model.Location, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	if s.closed {
 		return nil, utils.ErrInvalidConn
 	}
@@ -52,18 +168,185 @@ func (s *Connection) Get(ctx context.Context, ipAddress string) (*model.Location
 		return nil, ctx.Err()
 	default:
 	}
-	for _, l := range s.locations {
-		if l.IPAddress == ipAddress {
-			return &l, nil
+	valid, ipAddress := utils.IsIPValid(ipAddress)
+	if !valid {
+		return nil, utils.ErrBadRequest
+	}
+	ip := net.ParseIP(ipAddress)
+	var match *model.Location
+	var matchNetwork string
+	longest := -1
+	active := s.datasets[s.active]
+	for i, l := range active {
+		network := utils.NetworkOf(l)
+		_, ipNet, err := net.ParseCIDR(network)
+		if err != nil || !ipNet.Contains(ip) {
+			continue
+		}
+		if ones, _ := ipNet.Mask.Size(); ones > longest {
+			longest = ones
+			match = &active[i]
+			matchNetwork = network
 		}
 	}
-	return nil, utils.ErrNotFound
+	if match == nil {
+		return nil, utils.ErrNotFound
+	}
+	location := *match
+	location.IPAddress = ipAddress
+	location.Network = matchNetwork
+	return &location, nil
+}
+
+func (s *Connection) GetMany(ctx context.Context, ipAddresses []string) (map[string]*model.Location, error) {
+	locations := make(map[string]*model.Location, len(ipAddresses))
+	for _, ipAddress := range ipAddresses {
+		location, err := s.Get(ctx, ipAddress)
+		if err != nil {
+			if errors.Is(err, utils.ErrNotFound) {
+				continue
+			}
+			return nil, err
+		}
+		locations[location.IPAddress] = location
+	}
+	return locations, nil
+}
+
+func (s *Connection) CreateDataset(ctx context.Context) (*model.Dataset, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, utils.ErrInvalidConn
+	}
+	version := 0
+	for v := range s.datasets {
+		if v > version {
+			version = v
+		}
+	}
+	version++
+	s.datasets[version] = append([]model.Location{}, s.datasets[s.active]...)
+	s.loading[version] = true
+	return &model.Dataset{Version: version, Status: model.DatasetLoading}, nil
+}
+
+func (s *Connection) ActivateDataset(ctx context.Context, version int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return utils.ErrInvalidConn
+	}
+	if _, ok := s.datasets[version]; !ok {
+		return utils.ErrDatasetNotFound
+	}
+	s.active = version
+	delete(s.loading, version)
+	return nil
+}
+
+func (s *Connection) DropDataset(ctx context.Context, version int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return utils.ErrInvalidConn
+	}
+	if _, ok := s.datasets[version]; !ok {
+		return utils.ErrDatasetNotFound
+	}
+	if version == s.active {
+		return utils.ErrDatasetActive
+	}
+	delete(s.datasets, version)
+	delete(s.loading, version)
+	delete(s.present, version)
+	return nil
+}
+
+func (s *Connection) Datasets(ctx context.Context) ([]model.Dataset, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, utils.ErrInvalidConn
+	}
+	resumable := map[int]string{}
+	for _, checkpoint := range s.checkpoints {
+		resumable[checkpoint.Dataset] = checkpoint.File
+	}
+	datasets := []model.Dataset{}
+	for v, locations := range s.datasets {
+		d := model.Dataset{Version: v, Status: model.DatasetReady, Locations: len(locations), Active: v == s.active}
+		if s.loading[v] {
+			d.Status, d.Resumable = model.DatasetLoading, resumable[v]
+		}
+		datasets = append(datasets, d)
+	}
+	sort.Slice(datasets, func(i, j int) bool { return datasets[i].Version < datasets[j].Version })
+	return datasets, nil
+}
+
+func (s *Connection) Source(ctx context.Context, url string) (*model.Source, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, utils.ErrInvalidConn
+	}
+	source, ok := s.sources[url]
+	if !ok {
+		return nil, utils.ErrNotFound
+	}
+	return &source, nil
+}
+
+func (s *Connection) SaveSource(ctx context.Context, source model.Source) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return utils.ErrInvalidConn
+	}
+	s.sources[source.URL] = source
+	return nil
+}
+
+func (s *Connection) Checkpoint(ctx context.Context, file string) (*model.Checkpoint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, utils.ErrInvalidConn
+	}
+	checkpoint, ok := s.checkpoints[file]
+	if !ok {
+		return nil, utils.ErrNotFound
+	}
+	return &checkpoint, nil
+}
+
+func (s *Connection) SaveCheckpoint(ctx context.Context, checkpoint model.Checkpoint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return utils.ErrInvalidConn
+	}
+	s.checkpoints[checkpoint.File] = checkpoint
+	return nil
+}
+
+func (s *Connection) DeleteCheckpoint(ctx context.Context, file string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return utils.ErrInvalidConn
+	}
+	delete(s.checkpoints, file)
+	return nil
 }
 
 func (s *Connection) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	if s.closed {
 		return utils.ErrInvalidConn
 	}
-	s.locations = nil
+	s.datasets = nil
 	return nil
 }
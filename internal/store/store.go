@@ -0,0 +1,19 @@
+package store
+
+import (
+	"geolocation/internal"
+	"geolocation/internal/model"
+	"geolocation/internal/store/database"
+	"geolocation/internal/store/memory"
+)
+
+// New creates the store selected by the configured DB_DRIVER,
+// memory selects the in-memory store, any other driver is handed over to database/sql
+func New(cfg model.DB) (internal.Store, error) {
+	switch cfg.Driver {
+	case memory.Driver:
+		return memory.New(cfg)
+	default:
+		return database.New(cfg)
+	}
+}
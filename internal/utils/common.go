@@ -3,6 +3,9 @@ package utils
 import (
 	"errors"
 	"geolocation/internal/model"
+	"net"
+	"reflect"
+	"regexp"
 	"strconv"
 	"strings"
 
@@ -12,21 +15,18 @@ import (
 
 var logger *log.Logger
 
-const (
-	CreateTableScript = `CREATE TABLE IF NOT EXISTS geolocation (
-		ip_address 		varchar not null PRIMARY KEY,
-		country_code 	varchar not null,
-		country 		varchar not null,
-		city 			varchar not null,
-		latitude 		varchar not null,
-		longitude 		varchar not null,
-		mystery_value 	varchar not null)`
-)
+// DefaultDatasetRetention is the number of inactive datasets kept when none is configured
+const DefaultDatasetRetention = 3
 
 var (
 	ErrInvalidConn         = errors.New("invalid db connection")
 	ErrBadRequest          = errors.New("you must provide a valid ip address")
+	ErrBadBatchRequest     = errors.New("you must provide a non empty JSON array of ip addresses")
+	ErrBatchTooLarge       = errors.New("too many ip addresses in a single request")
 	ErrNotFound            = errors.New("not found")
+	ErrConflict            = errors.New("location already exists")
+	ErrDatasetNotFound     = errors.New("dataset not found")
+	ErrDatasetActive       = errors.New("dataset is active")
 	ErrInternalServerError = errors.New("there was an error processing your request, please re-try after sometime")
 )
 
@@ -49,17 +49,109 @@ func GetDBCfg() (*model.DB, error) {
 	return &dbCfg, nil
 }
 
+// GetColumnsCfg prepares the csv column mapping by reading ENV vars, every one a comma separated list of header names
+func GetColumnsCfg() (*model.Columns, error) {
+	columnsCfg := model.Columns{}
+	err := viper.Unmarshal(&columnsCfg)
+	if err != nil {
+		return nil, err
+	}
+	return &columnsCfg, nil
+}
+
+// GetS3Cfg prepares the S3 compatible object storage configuration by reading ENV vars
+func GetS3Cfg() (*model.S3, error) {
+	s3Cfg := model.S3{}
+	err := viper.Unmarshal(&s3Cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Cfg, nil
+}
+
+// IsIPValid validates an IPv4 or IPv6 address and returns it in canonical form,
+// IPv4 in dotted decimal (including IPv4-mapped IPv6 addresses such as ::ffff:1.2.3.4)
+// and IPv6 in its compressed RFC 5952 form, so that every textual variant maps to the same key.
 func IsIPValid(ip string) (bool, string) {
-	parts := strings.Split(ip, ".")
-	if len(parts) != 4 {
+	parsed := net.ParseIP(strings.TrimSpace(ip))
+	if parsed == nil {
 		return false, ip
 	}
-	for _, part := range parts {
-		if _, err := strconv.Atoi(part); err != nil {
-			return false, ip
+	if v4 := parsed.To4(); v4 != nil {
+		return true, v4.String()
+	}
+	return true, parsed.String()
+}
+
+// IsNetworkValid validates an IPv4 or IPv6 network in CIDR notation and returns it in canonical form,
+// host bits are masked off and IPv4-mapped IPv6 networks are resolved to their IPv4 equivalent
+func IsNetworkValid(network string) (bool, string) {
+	_, ipNet, err := net.ParseCIDR(strings.TrimSpace(network))
+	if err != nil {
+		return false, network
+	}
+	ones, bits := ipNet.Mask.Size()
+	if v4 := ipNet.IP.To4(); v4 != nil {
+		if bits == 8*net.IPv6len {
+			if ones < 96 {
+				return false, network
+			}
+			ones -= 96
+		}
+		return true, v4.String() + "/" + strconv.Itoa(ones)
+	}
+	return true, ipNet.String()
+}
+
+// HostNetwork returns the single host network (/32 for IPv4, /128 for IPv6) of a canonical ip address
+func HostNetwork(ip string) string {
+	if strings.Contains(ip, ":") {
+		return ip + "/128"
+	}
+	return ip + "/32"
+}
+
+// NetworkOf returns the network a location covers, falling back to the host network of its ip address,
+// a host & its /32 (or /128) network are the same key to every store
+func NetworkOf(location model.Location) string {
+	if location.Network != "" {
+		return location.Network
+	}
+	return HostNetwork(location.IPAddress)
+}
+
+// DedupeLocations drops every location whose network (see NetworkOf) repeats within locations,
+// keeping the last occurrence when conflicts are updated & the first one otherwise.
+// Returns the remaining locations in their original order along with the number of dropped ones
+func DedupeLocations(locations []model.Location, policy model.ConflictPolicy) ([]model.Location, int) {
+	seen := make(map[string]int, len(locations))
+	for i, l := range locations {
+		if _, ok := seen[NetworkOf(l)]; !ok || policy == model.ConflictUpdate {
+			seen[NetworkOf(l)] = i
+		}
+	}
+	if len(seen) == len(locations) {
+		return locations, 0
+	}
+	unique := make([]model.Location, 0, len(seen))
+	for i, l := range locations {
+		if seen[NetworkOf(l)] == i {
+			unique = append(unique, l)
 		}
 	}
-	return true, ip
+	return unique, len(locations) - len(unique)
+}
+
+// SameLocation reports whether two locations carry the same data
+func SameLocation(a, b model.Location) bool {
+	return a.IPAddress == b.IPAddress &&
+		a.Network == b.Network &&
+		a.CountryCode == b.CountryCode &&
+		a.Country == b.Country &&
+		a.City == b.City &&
+		a.Latitude == b.Latitude &&
+		a.Longitude == b.Longitude &&
+		reflect.DeepEqual(a.MysteryValue, b.MysteryValue)
 }
 
 func IsStringValid(s string) (bool, string) {
@@ -67,6 +159,18 @@ func IsStringValid(s string) (bool, string) {
 	return len(s) > 0, s
 }
 
+var numeric = regexp.MustCompile(`^[+-]?([0-9]+(\.[0-9]*)?|\.[0-9]+)([eE][+-]?[0-9]+)?$`)
+
+// IsNumericValid validates an optional decimal number, keeping its exact textual form,
+// an empty (or blank) value is valid & returned as an empty string
+func IsNumericValid(s string) (bool, string) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return true, s
+	}
+	return numeric.MatchString(s), s
+}
+
 func IsFloat64Valid(s string) (bool, float64) {
 	v, err := strconv.ParseFloat(s, 64)
 	return err == nil, v
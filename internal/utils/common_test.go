@@ -1,6 +1,8 @@
 package utils
 
 import (
+	"geolocation/internal/model"
+	"reflect"
 	"testing"
 )
 
@@ -38,6 +40,38 @@ func TestIsIPValid(t *testing.T) {
 			valid: false,
 			ip:    "200.106.141.er",
 		},
+		{
+			name: "valid ipv6 address should pass",
+			args: args{
+				ip: "2001:db8::68",
+			},
+			valid: true,
+			ip:    "2001:db8::68",
+		},
+		{
+			name: "expanded ipv6 address should be compressed",
+			args: args{
+				ip: "2001:0DB8:0000:0000:0000:0000:0000:0068",
+			},
+			valid: true,
+			ip:    "2001:db8::68",
+		},
+		{
+			name: "ipv4 mapped ipv6 address should be resolved to ipv4",
+			args: args{
+				ip: "::ffff:200.106.141.15",
+			},
+			valid: true,
+			ip:    "200.106.141.15",
+		},
+		{
+			name: "invalid ipv6 address should not pass",
+			args: args{
+				ip: "2001:db8:::68",
+			},
+			valid: false,
+			ip:    "2001:db8:::68",
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -131,3 +165,121 @@ func TestIsFloat64Valid(t *testing.T) {
 		})
 	}
 }
+
+func TestIsNetworkValid(t *testing.T) {
+	tests := []struct {
+		name    string
+		network string
+		valid   bool
+		value   string
+	}{
+		{
+			name:    "valid ipv4 network should pass",
+			network: "200.106.0.0/16",
+			valid:   true,
+			value:   "200.106.0.0/16",
+		},
+		{
+			name:    "host bits should be masked off",
+			network: "200.106.141.15/24",
+			valid:   true,
+			value:   "200.106.141.0/24",
+		},
+		{
+			name:    "valid ipv6 network should pass",
+			network: "2001:0db8:0000::/32",
+			valid:   true,
+			value:   "2001:db8::/32",
+		},
+		{
+			name:    "ipv4 mapped ipv6 network should be resolved to ipv4",
+			network: "::ffff:200.106.141.0/120",
+			valid:   true,
+			value:   "200.106.141.0/24",
+		},
+		{
+			name:    "missing prefix length should fail",
+			network: "200.106.141.0",
+			valid:   false,
+			value:   "200.106.141.0",
+		},
+		{
+			name:    "out of range prefix length should fail",
+			network: "200.106.141.0/33",
+			valid:   false,
+			value:   "200.106.141.0/33",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, got1 := IsNetworkValid(tt.network)
+			if got != tt.valid {
+				t.Errorf("IsNetworkValid() got = %v, want %v", got, tt.valid)
+			}
+			if got1 != tt.value {
+				t.Errorf("IsNetworkValid() got1 = %v, want %v", got1, tt.value)
+			}
+		})
+	}
+}
+
+func TestIsNumericValid(t *testing.T) {
+	tests := []struct {
+		name  string
+		s     string
+		valid bool
+		value string
+	}{
+		{name: "integer value should pass", s: "7823011346", valid: true, value: "7823011346"},
+		{name: "decimal value should pass", s: " -84.875 ", valid: true, value: "-84.875"},
+		{name: "exponent value should pass", s: "1e5", valid: true, value: "1e5"},
+		{name: "empty value should pass", s: "", valid: true, value: ""},
+		{name: "non numeric value should fail", s: "hello", valid: false, value: "hello"},
+		{name: "hexadecimal value should fail", s: "0x1f", valid: false, value: "0x1f"},
+		{name: "NaN should fail", s: "NaN", valid: false, value: "NaN"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, got1 := IsNumericValid(tt.s)
+			if got != tt.valid {
+				t.Errorf("IsNumericValid() got = %v, want %v", got, tt.valid)
+			}
+			if got1 != tt.value {
+				t.Errorf("IsNumericValid() got1 = %v, want %v", got1, tt.value)
+			}
+		})
+	}
+}
+
+func TestDedupeLocations(t *testing.T) {
+	locations := []model.Location{
+		{IPAddress: "200.106.141.15", City: "Gradymouth"},
+		{IPAddress: "70.95.73.73", City: "DuBuquemouth"},
+		{IPAddress: "200.106.141.15", City: "Port Karson"},
+		{IPAddress: "70.95.73.73/32", Network: "70.95.73.73/32", City: "New Neva"},
+	}
+	tests := []struct {
+		name       string
+		policy     model.ConflictPolicy
+		cities     []string
+		duplicates int
+	}{
+		{name: "skip should keep the first occurrence", policy: model.ConflictSkip, cities: []string{"Gradymouth", "DuBuquemouth"}, duplicates: 2},
+		{name: "update should keep the last occurrence", policy: model.ConflictUpdate, cities: []string{"Port Karson", "New Neva"}, duplicates: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, duplicates := DedupeLocations(locations, tt.policy)
+			if duplicates != tt.duplicates {
+				t.Errorf("DedupeLocations() duplicates = %v, want %v", duplicates, tt.duplicates)
+			}
+			cities := []string{}
+			for _, l := range got {
+				cities = append(cities, l.City)
+			}
+			if !reflect.DeepEqual(cities, tt.cities) {
+				t.Errorf("DedupeLocations() got = %v, want %v", cities, tt.cities)
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package service
+
+import (
+	"geolocation/internal/model"
+	"unsafe"
+)
+
+// DefaultBatchSize is the number of locations buffered before they get flushed to the store
+const DefaultBatchSize = 10000
+
+// locationOverhead is the memory a location takes besides the bytes of its strings
+const locationOverhead = int(unsafe.Sizeof(model.Location{}))
+
+// batch buffers sanitised locations until either its size or its memory limit is reached,
+// along with the locations of a synced dump to mark present until as many as its size are,
+// its buffers are reused across flushes so an ingestion runs in constant memory
+type batch struct {
+	locations []model.Location
+	present   []model.Location
+	size      int
+	limit     int
+	bytes     int
+}
+
+// newBatch creates a batch holding at most size locations & (roughly) limit bytes, a limit <= 0 means no memory limit
+func newBatch(size, limit int) *batch {
+	if size <= 0 {
+		size = DefaultBatchSize
+	}
+	return &batch{locations: make([]model.Location, 0, size), size: size, limit: limit}
+}
+
+// add buffers a location & reports whether the batch is full and must be flushed
+func (b *batch) add(l model.Location) bool {
+	b.locations = append(b.locations, l)
+	b.bytes += locationOverhead + len(l.IPAddress) + len(l.Network) + len(l.CountryCode) + len(l.Country) + len(l.City)
+	if v, ok := l.MysteryValue.(string); ok {
+		b.bytes += len(v)
+	}
+	return len(b.locations) >= b.size || (b.limit > 0 && b.bytes >= b.limit)
+}
+
+// mark buffers locations to mark present, the batch must be flushed once as many as its size are
+func (b *batch) mark(present []model.Location) {
+	b.present = append(b.present, present...)
+}
+
+// reset empties the batch, keeping its buffers
+func (b *batch) reset() {
+	b.locations = b.locations[:0]
+	b.present = b.present[:0]
+	b.bytes = 0
+}
@@ -0,0 +1,141 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"geolocation/internal"
+	"geolocation/internal/model"
+	"geolocation/internal/utils"
+	"io"
+	"os"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Checksum returns the sha256 checksum of a file, identifying it in its checkpoints (see IngestOptions.Checkpoint)
+func Checksum(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// startCheckpoint returns the checkpoint an ingestion of the file starts from, along with the dataset it resumes loading.
+// Resuming requires a checkpoint of the same file (by checksum) whose dataset is still loading, copied from the active one.
+// Any other checkpoint of the file is expired, along with its dataset, so that a failed ingestion is never left behind
+func startCheckpoint(ctx context.Context, store internal.Store, file model.Checkpoint, resume bool) (*model.Checkpoint, *model.Dataset, error) {
+	previous, err := store.Checkpoint(ctx, file.File)
+	if err != nil && !errors.Is(err, utils.ErrNotFound) {
+		return nil, nil, fmt.Errorf("Checkpoint() failed, err: %w", err)
+	}
+	datasets, err := store.Datasets(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Datasets() failed, err: %w", err)
+	}
+	if !resume {
+		if previous != nil {
+			expireCheckpoint(ctx, store, *previous)
+		}
+		runID, err := newRunID()
+		if err != nil {
+			return nil, nil, err
+		}
+		return &model.Checkpoint{RunID: runID, File: file.File, Checksum: file.Checksum, Base: activeVersion(datasets)}, nil, nil
+	}
+
+	if previous == nil {
+		return nil, nil, fmt.Errorf("no checkpoint of %s to resume from", file.File)
+	}
+	if previous.Checksum != file.Checksum {
+		expireCheckpoint(ctx, store, *previous)
+		return nil, nil, fmt.Errorf("%s changed since its checkpoint (run %s), it has to be ingested from scratch", file.File, previous.RunID)
+	}
+	if active := activeVersion(datasets); active != previous.Base {
+		expireCheckpoint(ctx, store, *previous)
+		return nil, nil, fmt.Errorf("dataset %d got activated since the checkpoint of %s (run %s) copied dataset %d, it has to be ingested from scratch", active, file.File, previous.RunID, previous.Base)
+	}
+	for _, d := range datasets {
+		if d.Version == previous.Dataset && d.Status == model.DatasetLoading && !d.Active {
+			d := d
+			return previous, &d, nil
+		}
+	}
+	expireCheckpoint(ctx, store, *previous)
+	return nil, nil, fmt.Errorf("%w: dataset %d of the checkpoint of %s (run %s) can't be resumed", utils.ErrDatasetNotFound, previous.Dataset, file.File, previous.RunID)
+}
+
+// expireCheckpoint forgets a checkpoint which can't be resumed (any longer) & drops its dataset, both best effort
+func expireCheckpoint(ctx context.Context, store internal.Store, checkpoint model.Checkpoint) {
+	logger := utils.GetLogger().WithFields(logrus.Fields{"dataset": checkpoint.Dataset, "file": checkpoint.File, "run": checkpoint.RunID})
+	datasets, err := store.Datasets(ctx)
+	if err != nil {
+		logger.WithFields(logrus.Fields{"err": err}).Error("Datasets() failed, the dataset of the unfinished ingestion is left behind")
+	}
+	// the dataset may already be gone, or have been activated (e.g. by hand), only a loading one is dropped
+	for _, d := range datasets {
+		if d.Version == checkpoint.Dataset && d.Status == model.DatasetLoading && !d.Active {
+			if err := store.DropDataset(ctx, d.Version); err != nil && !errors.Is(err, utils.ErrDatasetNotFound) {
+				logger.WithFields(logrus.Fields{"err": err}).Error("DropDataset() failed, the dataset of the unfinished ingestion is left behind")
+			}
+		}
+	}
+	if err := store.DeleteCheckpoint(ctx, checkpoint.File); err != nil {
+		logger.WithFields(logrus.Fields{"err": err}).Error("DeleteCheckpoint() failed, a stale checkpoint is left behind")
+	}
+}
+
+// activeVersion returns the version of the active dataset, 0 when none is
+func activeVersion(datasets []model.Dataset) int {
+	for _, d := range datasets {
+		if d.Active {
+			return d.Version
+		}
+	}
+	return 0
+}
+
+// inputStart returns the position r is at when opened, which the offsets of its marks count from, should it be resumed
+// from by seeking
+func inputStart(r io.Reader, from mark) (int64, error) {
+	if rs, ok := r.(io.Seeker); ok && from.offset > 0 {
+		return rs.Seek(0, io.SeekCurrent)
+	}
+	return 0, nil
+}
+
+// resumeAfter positions r, opened at start, right after from: seeking past the rows already ingested when possible,
+// or discarding their bytes when discard is set (i.e. nothing got buffered out of r yet). It tells whether it did,
+// the caller skips the rows up to from.line otherwise
+func resumeAfter(r io.Reader, start int64, from mark, discard bool) (bool, error) {
+	if from.offset <= 0 {
+		return false, nil
+	}
+	if rs, ok := r.(io.Seeker); ok {
+		_, err := rs.Seek(start+from.offset, io.SeekStart)
+		return err == nil, err
+	}
+	if !discard {
+		return false, nil
+	}
+	_, err := io.CopyN(io.Discard, r, from.offset)
+	return err == nil, err
+}
+
+// newRunID returns a random run ID
+func newRunID() (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
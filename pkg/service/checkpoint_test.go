@@ -0,0 +1,174 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"geolocation/internal"
+	"geolocation/internal/model"
+	"geolocation/internal/store/mock"
+	"geolocation/internal/utils"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// flakyStore fails every BulkCreate after the first ok ones
+type flakyStore struct {
+	internal.Store
+	mu sync.Mutex
+	ok int
+}
+
+func (s *flakyStore) BulkCreate(ctx context.Context, locations []model.Location, opts model.WriteOptions) (model.WriteStat, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ok == 0 {
+		return model.WriteStat{}, errors.New("connection reset")
+	}
+	s.ok--
+	return s.Store.BulkCreate(ctx, locations, opts)
+}
+
+func TestCSVIngestor_IngestResume(t *testing.T) {
+	ctx := context.Background()
+	data, ndjson := strings.Builder{}, strings.Builder{}
+	data.WriteString(csv_header + "\n")
+	ndjson.WriteString("\n")
+	for i := 0; i < 3000; i++ {
+		ip := fmt.Sprintf("10.0.%d.%d", i/256, i%256)
+		if i%10 == 9 {
+			ip = "bogus"
+		}
+		data.WriteString(fmt.Sprintf("%s,NL,Netherlands,city-%d,52.3675734,4.9041389,%d\n", ip, i, i))
+		ndjson.WriteString(fmt.Sprintf(`{"ip_address": %q, "country_code": "NL", "country": "Netherlands", "city": "city-%d", "latitude": 52.3675734, "longitude": 4.9041389}`+"\n", ip, i))
+	}
+	file := model.Checkpoint{File: "dump.csv", Checksum: "cafe"}
+	tests := []struct {
+		name     string
+		format   Format
+		seekable bool
+		opts     IngestOptions
+	}{
+		{name: "csv should resume by seeking", format: FormatCSV, seekable: true, opts: IngestOptions{BatchSize: 100}},
+		{name: "csv should resume by skipping rows", format: FormatCSV, opts: IngestOptions{BatchSize: 100}},
+		{name: "failing on conflicts should resume exactly", format: FormatCSV, seekable: true, opts: IngestOptions{BatchSize: 100, Write: model.WriteOptions{OnConflict: model.ConflictFail}}},
+		{name: "many writers should resume", format: FormatCSV, opts: IngestOptions{BatchSize: 100, Writers: 3}},
+		{name: "duplicates read twice should resume", format: FormatCSV, opts: IngestOptions{BatchSize: 100, Duplicates: DuplicateLast}},
+		{name: "ndjson should resume by seeking", format: FormatNDJSON, seekable: true, opts: IngestOptions{BatchSize: 100}},
+		{name: "ndjson should resume by skipping bytes", format: FormatNDJSON, opts: IngestOptions{BatchSize: 100}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := data.String()
+			if tt.format == FormatNDJSON {
+				content = ndjson.String()
+			}
+			reader := func() io.Reader {
+				if tt.seekable {
+					return strings.NewReader(content)
+				}
+				return io.MultiReader(strings.NewReader(content))
+			}
+			conn, err := mock.New()
+			assert.Nil(t, err, "NewMockConnection() failed, expected no error, got %v", err)
+			opts := tt.opts
+			opts.Checkpoint = &file
+
+			// the ingestion fails half way, keeping its dataset & checkpoint
+			flaky := &flakyStore{Store: conn, ok: 12}
+			ingestor, _ := NewIngestor(tt.format, flaky, reader(), opts)
+			_, err = ingestor.Ingest(ctx)
+			assert.NotNil(t, err, "expected Ingest() to fail, got nil")
+			checkpoint, err := conn.Checkpoint(ctx, file.File)
+			assert.Nil(t, err, "Checkpoint() failed, expected no error, got %v", err)
+			assert.Greater(t, checkpoint.Line, 1, "expected the checkpoint to move past the header")
+			assert.Less(t, checkpoint.Line, 3001, "expected the checkpoint to stop before the end")
+			datasets, _ := conn.Datasets(ctx)
+			assert.Equal(t, 2, len(datasets), "expected the dataset of the failed ingestion to be kept")
+			assert.Equal(t, model.DatasetLoading, datasets[1].Status, "expected the kept dataset to be loading")
+			assert.Equal(t, file.File, datasets[1].Resumable, "expected the kept dataset to be resumable")
+
+			// resuming writes the rest into the same dataset
+			opts.Resume = true
+			ingestor, _ = NewIngestor(tt.format, conn, reader(), opts)
+			stat, err := ingestor.Ingest(ctx)
+			assert.Nil(t, err, "Ingest() failed to resume, expected no error, got %v", err)
+			assert.Equal(t, checkpoint.Dataset, stat.Dataset, "expected the resumed dataset to be activated")
+			assert.Equal(t, checkpoint.RunID, stat.RunID, "expected the run ID to be kept")
+			assert.Equal(t, checkpoint.Line, stat.ResumedAt, "expected to resume after the checkpoint")
+			assert.Equal(t, 3001-checkpoint.Line, stat.Accepted+stat.Discarded, "expected only the rows after the checkpoint to be read")
+			if tt.opts.Writers <= 1 {
+				assert.Equal(t, stat.Accepted, stat.Inserted, "expected nothing to be written twice")
+			}
+			for _, ip := range []string{"10.0.0.0", "10.0.5.200", "10.0.11.182"} {
+				_, err := conn.Get(ctx, ip)
+				assert.Nil(t, err, "Get(%s) failed, expected no error, got %v", ip, err)
+			}
+			_, err = conn.Checkpoint(ctx, file.File)
+			assert.ErrorIs(t, err, utils.ErrNotFound, "expected the checkpoint to be deleted once complete, got %v", err)
+		})
+	}
+
+	conn, err := mock.New()
+	assert.Nil(t, err, "NewMockConnection() failed, expected no error, got %v", err)
+	_, err = NewCSVIngestor(conn, strings.NewReader(data.String()), IngestOptions{Checkpoint: &file, Resume: true}).Ingest(ctx)
+	assert.NotNil(t, err, "expected resuming without checkpoint to fail, got nil")
+	_, err = NewCSVIngestor(&flakyStore{Store: conn}, strings.NewReader(data.String()), IngestOptions{Checkpoint: &file}).Ingest(ctx)
+	assert.NotNil(t, err, "expected Ingest() to fail, got nil")
+	changed := model.Checkpoint{File: file.File, Checksum: "beef"}
+	_, err = NewCSVIngestor(conn, strings.NewReader(data.String()), IngestOptions{Checkpoint: &changed, Resume: true}).Ingest(ctx)
+	assert.NotNil(t, err, "expected resuming a changed file to fail, got nil")
+	_, err = conn.Checkpoint(ctx, file.File)
+	assert.ErrorIs(t, err, utils.ErrNotFound, "expected the checkpoint of a changed file to expire, got %v", err)
+	datasets, _ := conn.Datasets(ctx)
+	assert.Equal(t, 1, len(datasets), "expected the dataset of a changed file to expire")
+}
+
+func TestCSVIngestor_IngestResumeExpired(t *testing.T) {
+	ctx := context.Background()
+	data := csv_header + "\n" + "10.0.0.1,NL,Netherlands,Amsterdam,52.3675734,4.9041389,1\n"
+	file := model.Checkpoint{File: "dump.csv", Checksum: "cafe"}
+	tests := []struct {
+		name   string
+		expire func(conn *mock.Connection, checkpoint *model.Checkpoint) error
+	}{
+		{name: "another activated dataset should expire the checkpoint", expire: func(conn *mock.Connection, checkpoint *model.Checkpoint) error {
+			d, err := conn.CreateDataset(ctx)
+			if err != nil {
+				return err
+			}
+			return conn.ActivateDataset(ctx, d.Version)
+		}},
+		{name: "an activated dataset should not be resumed", expire: func(conn *mock.Connection, checkpoint *model.Checkpoint) error {
+			return conn.ActivateDataset(ctx, checkpoint.Dataset)
+		}},
+		{name: "a dropped dataset should expire the checkpoint", expire: func(conn *mock.Connection, checkpoint *model.Checkpoint) error {
+			return conn.DropDataset(ctx, checkpoint.Dataset)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := mock.New()
+			assert.Nil(t, err, "NewMockConnection() failed, expected no error, got %v", err)
+			_, err = NewCSVIngestor(&flakyStore{Store: conn}, strings.NewReader(data), IngestOptions{Checkpoint: &file}).Ingest(ctx)
+			assert.NotNil(t, err, "expected Ingest() to fail, got nil")
+			checkpoint, err := conn.Checkpoint(ctx, file.File)
+			assert.Nil(t, err, "Checkpoint() failed, expected no error, got %v", err)
+			assert.Equal(t, 1, checkpoint.Base, "expected the checkpoint to record the active dataset")
+			assert.Nil(t, tt.expire(conn, checkpoint), "expected no error")
+
+			_, err = NewCSVIngestor(conn, strings.NewReader(data), IngestOptions{Checkpoint: &file, Resume: true}).Ingest(ctx)
+			assert.NotNil(t, err, "expected resuming to fail, got nil")
+			_, err = conn.Checkpoint(ctx, file.File)
+			assert.ErrorIs(t, err, utils.ErrNotFound, "expected the checkpoint to expire, got %v", err)
+			datasets, _ := conn.Datasets(ctx)
+			for _, d := range datasets {
+				assert.NotEqual(t, model.DatasetLoading, d.Status, "expected no loading dataset to be left behind, got %d", d.Version)
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package service
+
+import (
+	"fmt"
+	"geolocation/internal/model"
+	"strings"
+	"unicode"
+)
+
+// layout tells where every column sits within a row
+type layout struct {
+	// index of every column, -1 when the file lacks it
+	index [columns]int
+	// width is the number of columns every row must have
+	width int
+}
+
+// aliases are the header names every column is known by on top of its own name
+var aliases = map[column][]string{
+	ip_address: {"ip_network"},
+}
+
+// optional columns may be missing from a file
+var optional = map[column]bool{
+	mystery_value: true,
+}
+
+// newLayout finds every column within a header by name, either its own, a built-in alias or one out of cfg.
+// Names are matched case insensitively, disregarding whitespace, '_' & '-' (e.g. "Country Code" matches country_code),
+// columns unknown to the mapping are ignored.
+func newLayout(header []string, cfg model.Columns) (*layout, error) {
+	names, err := columnNames(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &layout{width: len(header)}
+	for c := range l.index {
+		l.index[c] = -1
+	}
+	for i, name := range header {
+		c, ok := names[normalise(name)]
+		if !ok {
+			continue
+		}
+		if l.index[c] >= 0 {
+			return nil, fmt.Errorf("invalid csv header, both %q & %q name %s", header[l.index[c]], name, c)
+		}
+		l.index[c] = i
+	}
+	missing := []string{}
+	for c := ip_address; c < columns; c++ {
+		if l.index[c] < 0 && !optional[c] {
+			missing = append(missing, c.String())
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("invalid csv header, missing column(s): %s", strings.Join(missing, ", "))
+	}
+	return l, nil
+}
+
+// columnNames maps every (normalised) name a column is known by, its own, built-in aliases & the ones out of cfg
+func columnNames(cfg model.Columns) (map[string]column, error) {
+	configured := map[column][]string{
+		ip_address:    cfg.IPAddress,
+		country_code:  cfg.CountryCode,
+		country:       cfg.Country,
+		city:          cfg.City,
+		latitude:      cfg.Latitude,
+		longitude:     cfg.Longitude,
+		mystery_value: cfg.MysteryValue,
+	}
+	names := map[string]column{}
+	for c := ip_address; c < columns; c++ {
+		for _, name := range append(append([]string{c.String()}, aliases[c]...), configured[c]...) {
+			if other, ok := names[normalise(name)]; ok && other != c {
+				return nil, fmt.Errorf("invalid column mapping, %q names both %s & %s", name, other, c)
+			}
+			names[normalise(name)] = c
+		}
+	}
+	return names, nil
+}
+
+// value returns the value of a column within a row, empty when the file lacks it
+func (l *layout) value(values []string, c column) string {
+	if i := l.index[c]; i >= 0 {
+		return values[i]
+	}
+	return ""
+}
+
+// normalise turns a header name into its comparable form
+func normalise(name string) string {
+	words := strings.FieldsFunc(strings.ToLower(strings.TrimPrefix(name, "\ufeff")), func(r rune) bool {
+		return unicode.IsSpace(r) || r == '_' || r == '-'
+	})
+	return strings.Join(words, "_")
+}
@@ -0,0 +1,159 @@
+package service
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// File is a file to ingest, possibly a member of an archive
+type File struct {
+	// Name of the file, which tells its format (see FormatOf)
+	Name string
+	// Open opens the (decompressed) content of the file, every file gets opened once
+	Open func() (io.ReadCloser, error)
+	// Size is the size of the (decompressed) content of the file, 0 when unknown
+	Size int64
+}
+
+// magic bytes of the supported compressions
+var (
+	gzipMagic     = []byte{0x1f, 0x8b}
+	zstdMagic     = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	zipMagic      = []byte("PK\x03\x04")
+	emptyZipMagic = []byte("PK\x05\x06")
+)
+
+// Unpack tells whether r is gzip, zstd or zip compressed by its magic bytes (regardless of name)
+// & returns the files to ingest out of it, decompressed as they get read:
+// a single file named after r (minus .gz or .zst) for gzip & zstd, every member of a known format (see FormatOf)
+// in archive order for zip, or r itself when uncompressed.
+// release frees whatever got spooled to read r, once the files are no longer needed
+func Unpack(name string, r io.Reader) (files []File, release func(), err error) {
+	release = func() {}
+	magic, r, err := peek(r, len(zstdMagic))
+	if err != nil {
+		return nil, release, err
+	}
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return []File{{Name: trimExt(name, ".gz", ".gzip"), Open: func() (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		}}}, release, nil
+	case bytes.HasPrefix(magic, zstdMagic):
+		return []File{{Name: trimExt(name, ".zst", ".zstd"), Open: func() (io.ReadCloser, error) {
+			d, err := zstd.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return d.IOReadCloser(), nil
+		}}}, release, nil
+	case bytes.HasPrefix(magic, zipMagic), bytes.HasPrefix(magic, emptyZipMagic):
+		return unzip(name, r)
+	}
+	return []File{{Name: name, Open: func() (io.ReadCloser, error) { return nopCloser(r), nil }, Size: sizeOf(r)}}, release, nil
+}
+
+// unzip lists the members of a zip archive worth ingesting,
+// the archive gets spooled to a temp file unless r can be read at random
+func unzip(name string, r io.Reader) ([]File, func(), error) {
+	release := func() {}
+	ra, size, err := readerAt(r)
+	if err != nil {
+		return nil, release, err
+	}
+	if ra == nil {
+		spool, err := os.CreateTemp("", "geolocation-*.spool")
+		if err != nil {
+			return nil, release, fmt.Errorf("CreateTemp() failed, err: %w", err)
+		}
+		release = func() {
+			spool.Close()
+			os.Remove(spool.Name())
+		}
+		if size, err = io.Copy(spool, r); err != nil {
+			release()
+			return nil, func() {}, fmt.Errorf("spooling %s failed, err: %w", name, err)
+		}
+		ra = spool
+	}
+
+	archive, err := zip.NewReader(ra, size)
+	if err != nil {
+		release()
+		return nil, func() {}, fmt.Errorf("%s: %w", name, err)
+	}
+	files := []File{}
+	for _, member := range archive.File {
+		if member.FileInfo().IsDir() {
+			continue
+		}
+		if _, err := FormatOf(member.Name); err != nil {
+			continue
+		}
+		member := member
+		files = append(files, File{Name: path.Join(name, member.Name), Open: member.Open, Size: int64(member.UncompressedSize64)})
+	}
+	if len(files) == 0 {
+		release()
+		return nil, func() {}, fmt.Errorf("%s holds no csv, tsv or ndjson file", name)
+	}
+	return files, release, nil
+}
+
+// peek returns the first n bytes (or less) of r, along with a reader still starting from the first byte
+func peek(r io.Reader, n int) ([]byte, io.Reader, error) {
+	if rs, ok := r.(io.ReadSeeker); ok {
+		at, err := rs.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, nil, err
+		}
+		magic := make([]byte, n)
+		read, err := io.ReadFull(rs, magic)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return nil, nil, err
+		}
+		if _, err := rs.Seek(at, io.SeekStart); err != nil {
+			return nil, nil, err
+		}
+		return magic[:read], rs, nil
+	}
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(n)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, nil, err
+	}
+	return magic, br, nil
+}
+
+// readerAt returns r as an io.ReaderAt along with its size, nil when r can't be read at random
+func readerAt(r io.Reader) (io.ReaderAt, int64, error) {
+	ra, ok := r.(io.ReaderAt)
+	rs, seekable := r.(io.Seeker)
+	if !ok || !seekable {
+		return nil, 0, nil
+	}
+	size, err := rs.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, 0, err
+	}
+	return ra, size, nil
+}
+
+// trimExt trims the first of the given extensions name ends with
+func trimExt(name string, exts ...string) string {
+	for _, ext := range exts {
+		if strings.HasSuffix(strings.ToLower(name), ext) {
+			return name[:len(name)-len(ext)]
+		}
+	}
+	return name
+}
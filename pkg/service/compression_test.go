@@ -0,0 +1,175 @@
+package service
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"geolocation/internal/model"
+	"geolocation/internal/store/mock"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+)
+
+func gzipped(t *testing.T, data string) []byte {
+	buf := bytes.Buffer{}
+	w := gzip.NewWriter(&buf)
+	_, err := w.Write([]byte(data))
+	assert.Nil(t, err, "gzip Write() failed, expected no error, got %v", err)
+	assert.Nil(t, w.Close(), "gzip Close() failed")
+	return buf.Bytes()
+}
+
+func zstded(t *testing.T, data string) []byte {
+	buf := bytes.Buffer{}
+	w, err := zstd.NewWriter(&buf)
+	assert.Nil(t, err, "zstd NewWriter() failed, expected no error, got %v", err)
+	_, err = w.Write([]byte(data))
+	assert.Nil(t, err, "zstd Write() failed, expected no error, got %v", err)
+	assert.Nil(t, w.Close(), "zstd Close() failed")
+	return buf.Bytes()
+}
+
+// zipped archives the given members, in order, every one a name followed by its content
+func zipped(t *testing.T, members ...string) []byte {
+	buf := bytes.Buffer{}
+	w := zip.NewWriter(&buf)
+	for i := 0; i < len(members); i += 2 {
+		f, err := w.Create(members[i])
+		assert.Nil(t, err, "zip Create() failed, expected no error, got %v", err)
+		_, err = f.Write([]byte(members[i+1]))
+		assert.Nil(t, err, "zip Write() failed, expected no error, got %v", err)
+	}
+	assert.Nil(t, w.Close(), "zip Close() failed")
+	return buf.Bytes()
+}
+
+func TestUnpack(t *testing.T) {
+	data := csv_header + "\n200.106.141.15,SI,Nepal,DuBuquemouth,-84.87503094689836,7.206435933364332,7823011346\n"
+	tests := []struct {
+		name     string
+		file     string
+		data     []byte
+		seekable bool
+		files    []string
+		contents []string
+		wantErr  bool
+	}{
+		{name: "plain file should pass through", file: "dump.csv", data: []byte(data), files: []string{"dump.csv"}, contents: []string{data}},
+		{name: "gzip should be decompressed", file: "dump.csv.gz", data: gzipped(t, data), files: []string{"dump.csv"}, contents: []string{data}},
+		{name: "gzip should be told by content", file: "dump.csv", data: gzipped(t, data), seekable: true, files: []string{"dump.csv"}, contents: []string{data}},
+		{name: "zstd should be decompressed", file: "dump.csv.zst", data: zstded(t, data), files: []string{"dump.csv"}, contents: []string{data}},
+		{
+			name: "zip should list known members", file: "dump.zip", seekable: true,
+			data:     zipped(t, "a.csv", data, "README.txt", "hello", "dir/b.ndjson", "{}\n"),
+			files:    []string{"dump.zip/a.csv", "dump.zip/dir/b.ndjson"},
+			contents: []string{data, "{}\n"},
+		},
+		{
+			name: "zip should be spooled unless seekable", file: "dump.zip",
+			data:     zipped(t, "a.csv", data, "b.tsv", "x"),
+			files:    []string{"dump.zip/a.csv", "dump.zip/b.tsv"},
+			contents: []string{data, "x"},
+		},
+		{name: "zip without known members should fail", file: "dump.zip", data: zipped(t, "README.txt", "hello"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var r io.Reader = bytes.NewReader(tt.data)
+			if !tt.seekable {
+				r = io.MultiReader(r)
+			}
+			files, release, err := Unpack(tt.file, r)
+			defer release()
+			if tt.wantErr {
+				assert.NotNil(t, err, "expected Unpack() to fail, got %v", files)
+				return
+			}
+			assert.Nil(t, err, "Unpack() failed, expected no error, got %v", err)
+			names := []string{}
+			contents := []string{}
+			for _, f := range files {
+				names = append(names, f.Name)
+				rc, err := f.Open()
+				assert.Nil(t, err, "Open() failed, expected no error, got %v", err)
+				content, err := io.ReadAll(rc)
+				assert.Nil(t, err, "ReadAll() failed, expected no error, got %v", err)
+				rc.Close()
+				contents = append(contents, string(content))
+			}
+			assert.Equal(t, tt.files, names, "files must match, wanted %v, got %v", tt.files, names)
+			assert.Equal(t, tt.contents, contents, "decompressed contents must match")
+		})
+	}
+}
+
+func TestFilesIngestor_Ingest(t *testing.T) {
+	ctx := context.Background()
+	archive := zipped(t,
+		"a.csv", csv_header+"\n"+
+			"200.106.141.15,SI,Nepal,DuBuquemouth,-84.87503094689836,7.206435933364332,7823011346\n"+
+			"160.103.7.140,CZ,Nicaragua,,-68.31023296602508,-37.62435199624531,7301823115\n",
+		"notes.txt", "not a dump",
+		"b.tsv", "ip_address\tcountry_code\tcountry\tcity\tlatitude\tlongitude\n"+
+			"200.106.141.15\tNP\tNepal\tKathmandu\t27.7\t85.3\n"+
+			"70.95.73.73\tTL\tSaudi Arabia\tGradymouth\t-49.16675918861615\t-86.05920084416894\n",
+	)
+	tests := []struct {
+		name        string
+		duplicates  DuplicatePolicy
+		countryCode string
+		rejects     string
+	}{
+		{
+			name:        "first member should win",
+			duplicates:  DuplicateFirst,
+			countryCode: "SI",
+			rejects: "file,line,reason,ip_address,country_code,country,city,latitude,longitude,mystery_value\n" +
+				"dump.zip/a.csv,3,empty_city,160.103.7.140,CZ,Nicaragua,,-68.31023296602508,-37.62435199624531,7301823115\n" +
+				"dump.zip/b.tsv,2,conflicting_duplicate,200.106.141.15,NP,Nepal,Kathmandu,27.7,85.3\n",
+		},
+		{
+			name:        "last member should win",
+			duplicates:  DuplicateLast,
+			countryCode: "NP",
+			rejects: "file,line,reason,ip_address,country_code,country,city,latitude,longitude,mystery_value\n" +
+				"dump.zip/a.csv,2,conflicting_duplicate,200.106.141.15,SI,Nepal,DuBuquemouth,-84.87503094689836,7.206435933364332,7823011346\n" +
+				"dump.zip/a.csv,3,empty_city,160.103.7.140,CZ,Nicaragua,,-68.31023296602508,-37.62435199624531,7301823115\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := mock.New()
+			assert.Nil(t, err, "NewMockConnection() failed, expected no error, got %v", err)
+			files, release, err := Unpack("dump.zip", io.MultiReader(bytes.NewReader(archive)))
+			assert.Nil(t, err, "Unpack() failed, expected no error, got %v", err)
+			defer release()
+
+			rejects := strings.Builder{}
+			stat, err := NewFilesIngestor(conn, files, "", IngestOptions{Duplicates: tt.duplicates, Rejects: &rejects}).Ingest(ctx)
+			assert.Nil(t, err, "Ingest() failed, expected no error, got %v", err)
+			assert.Equal(t, 2, stat.Accepted, "expected %d accepted locations, got %d", 2, stat.Accepted)
+			assert.Equal(t, 2, stat.Discarded, "expected %d discarded locations, got %d", 2, stat.Discarded)
+			assert.Equal(t, map[model.RejectReason]int{model.RejectCity: 1, model.RejectConflictingDuplicate: 1}, stat.DiscardedBy, "discarded rows must be broken down by reason")
+			assert.Equal(t, tt.rejects, rejects.String(), "rejects must name the member of every discarded row")
+			got, err := conn.Get(ctx, "200.106.141.15")
+			assert.Nil(t, err, "Get() failed, expected no error, got %v", err)
+			assert.Equal(t, tt.countryCode, got.CountryCode, "country code must match, wanted %v, got %v", tt.countryCode, got.CountryCode)
+			_, err = conn.Get(ctx, "70.95.73.73")
+			assert.Nil(t, err, "Get() failed, expected the second member to be ingested, got %v", err)
+			assert.Equal(t, 2, len(stat.Files), "expected a stat per file, got %d", len(stat.Files))
+			if len(stat.Files) == 2 {
+				assert.Equal(t, "dump.zip/a.csv", stat.Files[0].Name, "file stats must be in order")
+				assert.Equal(t, stat.Accepted, stat.Files[0].Accepted+stat.Files[1].Accepted, "file stats must add up")
+				assert.Equal(t, stat.Discarded, stat.Files[0].Discarded+stat.Files[1].Discarded, "file stats must add up")
+			}
+		})
+	}
+
+	_, err := NewFilesIngestor(nil, []File{{Name: "dump.xlsx"}}, "", IngestOptions{}).Ingest(ctx)
+	assert.NotNil(t, err, "expected unknown format to fail, got nil")
+}
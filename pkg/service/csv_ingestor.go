@@ -3,13 +3,11 @@ package service
 import (
 	"context"
 	"encoding/csv"
-	"errors"
 	"geolocation/internal"
 	"geolocation/internal/model"
 	"geolocation/internal/utils"
 	"io"
 	"strings"
-	"time"
 )
 
 // CSVIngestor is intended to read valid geolocation data from a csv file
@@ -17,117 +15,182 @@ import (
 type CSVIngestor struct {
 	store internal.Store
 	r     io.Reader
+	opts  IngestOptions
 }
 
 // NewCSVIngestor creates new instance of CSVIngestor
-func NewCSVIngestor(store internal.Store, r io.Reader) *CSVIngestor {
-	return &CSVIngestor{store, r}
+func NewCSVIngestor(store internal.Store, r io.Reader, opts IngestOptions) *CSVIngestor {
+	return &CSVIngestor{store, r, opts}
 }
 
-// Ingest reads the csv file
-// extracts only valid location data by sanitising it.
-// Returns statistics in form of accepted & rejected locations and total time taken, alog with all valid locations
+// Ingest streams the csv file
+// extracts only valid location data by sanitising it, settles duplicates (see DuplicatePolicy)
+// & flushes it in batches into a new dataset (a copy of the active one)
+// which replaces the active dataset only once the load succeeded.
+// Returns statistics in form of accepted & rejected locations and total time taken,
 // possibly an error if any step fails
-func (c *CSVIngestor) Ingest(ctx context.Context) (*model.Stat, []model.Location, error) {
-	// make sure dependencies are intact or fail fast
-	if c.store == nil {
-		return nil, nil, errors.New("nil store")
-	}
-	if c.r == nil {
-		return nil, nil, errors.New("nil reader")
-	}
-
-	now := time.Now()
-	s := model.Stat{}
-	locations := []model.Location{}
-	csvRdr := csv.NewReader(c.r)
-	i := 0
-
-	// read & prepare valid locations
-	for {
-		select {
-		case <-ctx.Done():
-			return nil, nil, ctx.Err()
-		default:
-		}
-		values, err := csvRdr.Read()
-		if err != nil {
-			if err == io.EOF {
-				break
+func (c *CSVIngestor) Ingest(ctx context.Context) (*model.Stat, error) {
+	return ingest(ctx, c.store, single(c.r, csvFormat{comma: ','}), c.opts)
+}
+
+// TSVIngestor is intended to read valid geolocation data from a tab separated file
+// and ingest it in database
+type TSVIngestor struct {
+	store internal.Store
+	r     io.Reader
+	opts  IngestOptions
+}
+
+// NewTSVIngestor creates new instance of TSVIngestor
+func NewTSVIngestor(store internal.Store, r io.Reader, opts IngestOptions) *TSVIngestor {
+	return &TSVIngestor{store, r, opts}
+}
+
+// Ingest streams the tsv file, just like CSVIngestor.Ingest does with a csv file
+func (c *TSVIngestor) Ingest(ctx context.Context) (*model.Stat, error) {
+	return ingest(ctx, c.store, single(c.r, csvFormat{comma: '\t'}), c.opts)
+}
+
+// csvFormat reads delimiter separated files starting with a header
+type csvFormat struct {
+	comma rune
+}
+
+// open reads the header of the file & finds every column within it (see newLayout)
+func (f csvFormat) open(r io.Reader, cfg model.Columns, from mark) (func() (row, error), []string, *layout, error) {
+	start, err := inputStart(r, from)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	csvRdr := f.reader(r)
+	header, err := csvRdr.Read()
+	if err == io.EOF {
+		return func() (row, error) { return row{}, io.EOF }, nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	l, err := newLayout(header, cfg)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	// the header got buffered already, so rows can't be discarded short of reading them
+	base := mark{}
+	resumed, err := resumeAfter(r, start, from, false)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if resumed {
+		csvRdr, base = f.reader(r), from
+	}
+	read := func() (row, error) {
+		for {
+			values, err := csvRdr.Read()
+			if err != nil {
+				return row{}, err
 			}
-			return nil, nil, err
-		}
-		if i == 0 { // skip header
-			header := strings.Join(values, ",")
-			if header != csv_header {
-				return nil, nil, errors.New("invalid csv header, it must eqauls: " + csv_header)
+			line, _ := csvRdr.FieldPos(0)
+			if line += base.line; line > from.line {
+				return row{line: line, offset: base.offset + csvRdr.InputOffset(), values: values}, nil
 			}
-			i++
-			continue
-		}
-		if row := sanitise(values); row != nil {
-			locations = append(locations, *row)
-			s.Accepted++
-		} else {
-			s.Discarded++
 		}
 	}
+	return read, header, l, nil
+}
 
-	// ingest locations in database
-	err := c.store.BulkCreate(ctx, locations)
-	if err != nil {
-		return nil, nil, errors.New("BulkCreate() failed, err: " + err.Error())
+// reader creates a csv reader of the format
+func (f csvFormat) reader(r io.Reader) *csv.Reader {
+	csvRdr := csv.NewReader(r)
+	csvRdr.Comma = f.comma
+	csvRdr.FieldsPerRecord = -1 // rows with missing or extra columns get rejected by sanitise
+	if f.comma == '\t' {
+		csvRdr.LazyQuotes = true // tab separated files seldom quote their values
 	}
+	return csvRdr
+}
 
-	s.TimeSpent = time.Since(now)
-	return &s, locations, nil
+// address parses the first column, either a single address or a network in CIDR notation,
+// into the ip address & network of the location or returns the reason it's invalid
+func address(value string, location *model.Location) model.RejectReason {
+	if strings.Contains(value, "/") {
+		valid, network := utils.IsNetworkValid(value)
+		if !valid {
+			return model.RejectNetwork
+		}
+		location.IPAddress, location.Network = network, network
+		return ""
+	}
+	valid, ip := utils.IsIPValid(value)
+	if !valid {
+		return model.RejectIPAddress
+	}
+	location.IPAddress, location.Network = ip, utils.HostNetwork(ip)
+	return ""
 }
 
-func sanitise(values []string) *model.Location {
+// addressOf returns the ip address & network of a discarded row, provided its first column can still be parsed
+func addressOf(values []string, l *layout) (model.Location, bool) {
 	location := model.Location{}
-	for i, value := range values {
-		switch column(i) {
+	if i := l.index[ip_address]; i < 0 || i >= len(values) || address(values[i], &location) != "" {
+		return location, false
+	}
+	return location, true
+}
+
+// sanitise turns the values of a row into a location, or tells why the row has to be discarded
+func sanitise(values []string, l *layout) (*model.Location, model.RejectReason) {
+	if len(values) != l.width {
+		return nil, model.RejectColumnCount
+	}
+	location := model.Location{}
+	for c := ip_address; c < columns; c++ {
+		value := l.value(values, c)
+		switch c {
 		case ip_address:
-			if valid, ip := utils.IsIPValid(value); !valid {
-				return nil
-			} else {
-				location.IPAddress = ip
+			if reason := address(value, &location); reason != "" {
+				return nil, reason
 			}
 		case country_code:
 			if valid, cc := utils.IsStringValid(value); !valid {
-				return nil
+				return nil, model.RejectCountryCode
 			} else {
 				location.CountryCode = cc
 			}
 		case country:
 			if valid, c := utils.IsStringValid(value); !valid {
-				return nil
+				return nil, model.RejectCountry
 			} else {
 				location.Country = c
 			}
 		case city:
 			if valid, c := utils.IsStringValid(value); !valid {
-				return nil
+				return nil, model.RejectCity
 			} else {
 				location.City = c
 			}
 		case latitude:
 			if valid, l := utils.IsFloat64Valid(value); !valid {
-				return nil
+				return nil, model.RejectLatitude
 			} else {
 				location.Latitude = l
 			}
 		case longitude:
 			if valid, l := utils.IsFloat64Valid(value); !valid {
-				return nil
+				return nil, model.RejectLongitude
 			} else {
 				location.Longitude = l
 			}
 		case mystery_value:
-			location.MysteryValue = value
+			// optional, but must be numeric when present
+			if valid, v := utils.IsNumericValid(value); !valid {
+				return nil, model.RejectMysteryValue
+			} else if v != "" {
+				location.MysteryValue = v
+			}
 		}
 	}
-	return &location
+	return &location, ""
 }
 
 type column uint
@@ -140,5 +203,47 @@ const (
 	latitude
 	longitude
 	mystery_value
+	// columns is the number of known columns
+	columns
 )
+
+// String is the name of the column, as in csv_header
+func (c column) String() string {
+	return strings.Split(csv_header, ",")[c]
+}
+
+// rejectColumns tells which column a reason to discard a row blames
+var rejectColumns = map[model.RejectReason]column{
+	model.RejectIPAddress:    ip_address,
+	model.RejectNetwork:      ip_address,
+	model.RejectCountryCode:  country_code,
+	model.RejectCountry:      country,
+	model.RejectCity:         city,
+	model.RejectLatitude:     latitude,
+	model.RejectLongitude:    longitude,
+	model.RejectMysteryValue: mystery_value,
+}
+
+// discard accounts for a row discarded for the given reason
+func discard(s *model.Stat, reason model.RejectReason) {
+	s.Discarded++
+	if s.DiscardedBy == nil {
+		s.DiscardedBy = map[model.RejectReason]int{}
+	}
+	s.DiscardedBy[reason]++
+	if c, ok := rejectColumns[reason]; ok {
+		if s.DiscardedColumns == nil {
+			s.DiscardedColumns = map[string]int{}
+		}
+		s.DiscardedColumns[c.String()]++
+	}
+	switch reason {
+	case model.RejectDuplicate:
+		s.Duplicates++
+	case model.RejectConflictingDuplicate:
+		s.ConflictingDuplicates++
+	}
+}
+
+// csv_header names every known column, in their default order
 const csv_header = "ip_address,country_code,country,city,latitude,longitude,mystery_value"
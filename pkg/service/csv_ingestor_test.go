@@ -2,9 +2,11 @@ package service
 
 import (
 	"context"
+	"fmt"
 	"geolocation/internal"
 	"geolocation/internal/model"
 	"geolocation/internal/store/mock"
+	"geolocation/internal/utils"
 	"io"
 	"reflect"
 	"strings"
@@ -32,7 +34,7 @@ func TestNewCSVReader(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got := NewCSVIngestor(nil, tt.args.r)
+			got := NewCSVIngestor(nil, tt.args.r, IngestOptions{})
 			assert.NotNil(t, got, "NewCSVReader() failed, expected not nil, got nil")
 		})
 	}
@@ -50,7 +52,6 @@ func TestCSVReader_Read(t *testing.T) {
 		fields  fields
 		args    args
 		want    model.Stat
-		want1   []model.Location
 		wantErr bool
 	}{
 		// TODO: Add test cases.
@@ -60,7 +61,7 @@ func TestCSVReader_Read(t *testing.T) {
 			c := &CSVIngestor{
 				r: tt.fields.r,
 			}
-			got, got1, err := c.Ingest(tt.args.ctx)
+			got, err := c.Ingest(tt.args.ctx)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("CSVReader.Read() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -68,18 +69,18 @@ func TestCSVReader_Read(t *testing.T) {
 			if !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("CSVReader.Read() got = %v, want %v", got, tt.want)
 			}
-			if !reflect.DeepEqual(got1, tt.want1) {
-				t.Errorf("CSVReader.Read() got1 = %v, want %v", got1, tt.want1)
-			}
 		})
 	}
 }
 
 func Test_sanitise(t *testing.T) {
+	l, err := newLayout(strings.Split(csv_header, ","), model.Columns{})
+	assert.Nil(t, err, "newLayout() failed, expected no error, got %v", err)
 	tests := []struct {
 		name       string
 		line       string
 		result     *model.Location
+		reason     model.RejectReason
 		shouldPass bool
 	}{
 		{
@@ -96,33 +97,116 @@ func Test_sanitise(t *testing.T) {
 			},
 			shouldPass: true,
 		},
+		{
+			name: "valid ipv6 location should pass",
+			line: "2001:db8::68,NL,Netherlands,Amsterdam,52.3675734,4.9041389,7823011346",
+			result: &model.Location{
+				IPAddress:    "2001:db8::68",
+				CountryCode:  "NL",
+				Country:      "Netherlands",
+				City:         "Amsterdam",
+				Latitude:     52.3675734,
+				Longitude:    4.9041389,
+				MysteryValue: 7823011346,
+			},
+			shouldPass: true,
+		},
+		{
+			name: "valid network location should pass",
+			line: "200.106.0.0/16,SI,Nepal,DuBuquemouth,-84.87503094689836,7.206435933364332,7823011346",
+			result: &model.Location{
+				IPAddress:    "200.106.0.0/16",
+				Network:      "200.106.0.0/16",
+				CountryCode:  "SI",
+				Country:      "Nepal",
+				City:         "DuBuquemouth",
+				Latitude:     -84.87503094689836,
+				Longitude:    7.206435933364332,
+				MysteryValue: 7823011346,
+			},
+			shouldPass: true,
+		},
+		{
+			name:       "invalid valid location (network) should not pass",
+			line:       "200.106.0.0/40,SI,Nepal,DuBuquemouth,-84.87503094689836,7.206435933364332,7823011346",
+			result:     nil,
+			reason:     model.RejectNetwork,
+			shouldPass: false,
+		},
+		{
+			name: "missing mystery value should pass",
+			line: "200.106.141.15,SI,Nepal,DuBuquemouth,-84.87503094689836,7.206435933364332,",
+			result: &model.Location{
+				IPAddress:   "200.106.141.15",
+				CountryCode: "SI",
+				Country:     "Nepal",
+				City:        "DuBuquemouth",
+				Latitude:    -84.87503094689836,
+				Longitude:   7.206435933364332,
+			},
+			shouldPass: true,
+		},
+		{
+			name:       "non numeric mystery value should not pass",
+			line:       "200.106.141.15,SI,Nepal,DuBuquemouth,-84.87503094689836,7.206435933364332,bogus",
+			result:     nil,
+			reason:     model.RejectMysteryValue,
+			shouldPass: false,
+		},
 		{
 			name:       "invalid valid location (ip address) should not pass",
 			line:       "200.106.141.tyr,SI,Nepal,DuBuquemouth,-84.87503094689836,7.206435933364332,7823011346",
 			result:     nil,
+			reason:     model.RejectIPAddress,
 			shouldPass: false,
 		},
 		{
 			name:       "invalid valid location (missing ip address) should not pass",
 			line:       ",SI,Nepal,DuBuquemouth,-84.87503094689836,7.206435933364332,7823011346",
 			result:     nil,
+			reason:     model.RejectIPAddress,
+			shouldPass: false,
+		},
+		{
+			name:       "invalid valid location (empty city) should not pass",
+			line:       "200.106.141.15,SI,Nepal, ,-84.87503094689836,7.206435933364332,7823011346",
+			result:     nil,
+			reason:     model.RejectCity,
+			shouldPass: false,
+		},
+		{
+			name:       "invalid valid location (unparsable latitude) should not pass",
+			line:       "200.106.141.15,SI,Nepal,DuBuquemouth,north,7.206435933364332,7823011346",
+			result:     nil,
+			reason:     model.RejectLatitude,
+			shouldPass: false,
+		},
+		{
+			name:       "invalid valid location (missing column) should not pass",
+			line:       "200.106.141.15,SI,Nepal,DuBuquemouth,-84.87503094689836,7.206435933364332",
+			result:     nil,
+			reason:     model.RejectColumnCount,
 			shouldPass: false,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			args := strings.Split(tt.line, ",")
-			got := sanitise(args)
+			got, reason := sanitise(args, l)
 			if tt.shouldPass {
 				assert.NotNil(t, got, "wanted not nil location %#v, got nil location", tt.result)
 				assert.Equal(t, tt.result.City, got.City, "city must match, wanted %v, got %v", tt.result.City, got.City)
 				assert.Equal(t, tt.result.Country, got.Country, "country must match, wanted %v, got %v", tt.result.Country, got.Country)
 				assert.Equal(t, tt.result.CountryCode, got.CountryCode, "country code must match, wanted %v, got %v", tt.result.CountryCode, got.CountryCode)
 				assert.Equal(t, tt.result.IPAddress, got.IPAddress, "ip address must match, wanted %v, got %v", tt.result.IPAddress, got.IPAddress)
+				if tt.result.Network != "" {
+					assert.Equal(t, tt.result.Network, got.Network, "network must match, wanted %v, got %v", tt.result.Network, got.Network)
+				}
 				assert.Equal(t, tt.result.Latitude, got.Latitude, "latitude must match, wanted %v, got %v", tt.result.Latitude, got.Latitude)
 				assert.Equal(t, tt.result.Longitude, got.Longitude, "longitude must match, wanted %v, got %v", tt.result.Longitude, got.Longitude)
 			} else {
 				assert.Nil(t, got, "wanted nil location, got not nil location", got)
+				assert.Equal(t, tt.reason, reason, "reason must match, wanted %v, got %v", tt.reason, reason)
 			}
 		})
 	}
@@ -259,7 +343,7 @@ func TestCSVIngestor_Ingest(t *testing.T) {
 				store: tt.dependencies.store,
 				r:     tt.dependencies.r,
 			}
-			stat, locations, err := c.Ingest(tt.args.ctx)
+			stat, err := c.Ingest(tt.args.ctx)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("CSVIngestor.Ingest() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -267,12 +351,532 @@ func TestCSVIngestor_Ingest(t *testing.T) {
 			if tt.wantErr {
 				assert.NotNil(t, err, "expected not nill err, got nil")
 				assert.Nil(t, stat, "expected nill stat, got %#v", stat)
-				assert.Nil(t, locations, "expected nill locations, got %#v", locations)
 			} else {
 				assert.Equal(t, tt.stat.Accepted, stat.Accepted, "expected accepted location count %d does not match actual accepted location count %d", tt.stat.Accepted, stat.Accepted)
 				assert.Equal(t, tt.stat.Discarded, stat.Discarded, "expected discarded location count %d does not match actual discarded location count %d", tt.stat.Discarded, stat.Discarded)
-				assert.Equal(t, len(tt.locations), len(locations), "expected location count must match actual location count")
+				for _, l := range tt.locations {
+					got, err := tt.dependencies.store.Get(tt.args.ctx, l.IPAddress)
+					assert.Nil(t, err, "expected location %v to be stored, got %v", l.IPAddress, err)
+					assert.Equal(t, l.City, got.City, "city must match, wanted %v, got %v", l.City, got.City)
+				}
+			}
+		})
+	}
+}
+
+func TestCSVIngestor_IngestNetworks(t *testing.T) {
+	ctx := context.Background()
+	conn, err := mock.New()
+	assert.Nil(t, err, "NewMockConnection() failed, expected no error, got %v", err)
+	c := NewCSVIngestor(conn, strings.NewReader("ip_network,country_code,country,city,latitude,longitude,mystery_value\n"+
+		"200.0.0.0/8,SI,Nepal,DuBuquemouth,-84.87503094689836,7.206435933364332,7823011346\n"+
+		"200.106.0.0/16,CZ,Nicaragua,New Neva,-68.31023296602508,-37.62435199624531,7301823115\n"+
+		"200.106.141.15,TL,Saudi Arabia,Gradymouth,-49.16675918861615,-86.05920084416894,2559997162\n"+
+		"2001:db8::/32,LI,Guyana,Port Karson,-78.2274228596799,-163.26218895343357,1337885276\n"), IngestOptions{})
+	stat, err := c.Ingest(ctx)
+	assert.Nil(t, err, "Ingest() failed, expected no error, got %v", err)
+	assert.Equal(t, 4, stat.Accepted, "expected 4 accepted locations, got %d", stat.Accepted)
+
+	tests := []struct {
+		name    string
+		ip      string
+		network string
+		city    string
+		wantErr error
+	}{
+		{
+			name:    "host row should win over its enclosing networks",
+			ip:      "200.106.141.15",
+			network: "200.106.141.15/32",
+			city:    "Gradymouth",
+		},
+		{
+			name:    "most specific network should win",
+			ip:      "200.106.1.1",
+			network: "200.106.0.0/16",
+			city:    "New Neva",
+		},
+		{
+			name:    "least specific network should match when nothing narrower does",
+			ip:      "200.1.1.1",
+			network: "200.0.0.0/8",
+			city:    "DuBuquemouth",
+		},
+		{
+			name:    "ipv6 network should match",
+			ip:      "2001:db8::1",
+			network: "2001:db8::/32",
+			city:    "Port Karson",
+		},
+		{
+			name:    "address outside every network should not be found",
+			ip:      "10.0.0.1",
+			wantErr: utils.ErrNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := conn.Get(ctx, tt.ip)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr, "expected error %v, got %v", tt.wantErr, err)
+				return
 			}
+			assert.Nil(t, err, "Get() failed, expected no error, got %v", err)
+			assert.Equal(t, tt.ip, got.IPAddress, "ip address must match, wanted %v, got %v", tt.ip, got.IPAddress)
+			assert.Equal(t, tt.network, got.Network, "network must match, wanted %v, got %v", tt.network, got.Network)
+			assert.Equal(t, tt.city, got.City, "city must match, wanted %v, got %v", tt.city, got.City)
+		})
+	}
+}
+
+func TestCSVIngestor_IngestDatasets(t *testing.T) {
+	ctx := context.Background()
+	conn, err := mock.New()
+	assert.Nil(t, err, "NewMockConnection() failed, expected no error, got %v", err)
+
+	c := NewCSVIngestor(conn, strings.NewReader("ip_address,country_code,country,city,latitude,longitude,mystery_value\n"+
+		"200.106.141.15,SI,Nepal,DuBuquemouth,-84.87503094689836,7.206435933364332,7823011346\n"), IngestOptions{})
+	stat, err := c.Ingest(ctx)
+	assert.Nil(t, err, "Ingest() failed, expected no error, got %v", err)
+	assert.Equal(t, 2, stat.Dataset, "expected dataset 2 to be loaded, got %d", stat.Dataset)
+
+	// a failed ingestion must leave the active dataset untouched & drop its own
+	c = NewCSVIngestor(conn, strings.NewReader("bogus header\n"), IngestOptions{})
+	_, err = c.Ingest(ctx)
+	assert.NotNil(t, err, "expected Ingest() to fail, got nil")
+	datasets, err := conn.Datasets(ctx)
+	assert.Nil(t, err, "Datasets() failed, expected no error, got %v", err)
+	assert.Equal(t, 2, len(datasets), "expected 2 datasets, got %#v", datasets)
+	assert.True(t, datasets[1].Active, "expected dataset 2 to stay active, got %#v", datasets)
+	_, err = conn.Get(ctx, "200.106.141.15")
+	assert.Nil(t, err, "Get() failed, expected no error, got %v", err)
+}
+
+func TestCSVIngestor_IngestBatches(t *testing.T) {
+	ctx := context.Background()
+	data := "ip_address,country_code,country,city,latitude,longitude,mystery_value\n" +
+		"200.106.141.15,SI,Nepal,DuBuquemouth,-84.87503094689836,7.206435933364332,7823011346\n" +
+		"160.103.7.140,CZ,Nicaragua,New Neva,-68.31023296602508,-37.62435199624531,7301823115\n" +
+		"bogus,CZ,Nicaragua,New Neva,-68.31023296602508,-37.62435199624531,7301823115\n" +
+		"70.95.73.73,TL,Saudi Arabia,Gradymouth,-49.16675918861615,-86.05920084416894,2559997162\n" +
+		"200.106.141.15,SI,Nepal,DuBuquemouth,-84.87503094689836,7.206435933364332,7823011346\n" +
+		"125.159.20.54,LI,Guyana,Port Karson,-78.2274228596799,-163.26218895343357,1337885276\n"
+	tests := []struct {
+		name    string
+		opts    IngestOptions
+		batches int
+	}{
+		{name: "default batch size should write once", opts: IngestOptions{}, batches: 1},
+		{name: "batch size should bound every write", opts: IngestOptions{BatchSize: 2}, batches: 2},
+		{name: "memory limit should bound every write", opts: IngestOptions{MemoryLimit: 1}, batches: 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := mock.New()
+			assert.Nil(t, err, "NewMockConnection() failed, expected no error, got %v", err)
+			stat, err := NewCSVIngestor(conn, strings.NewReader(data), tt.opts).Ingest(ctx)
+			assert.Nil(t, err, "Ingest() failed, expected no error, got %v", err)
+			assert.Equal(t, tt.batches, stat.Batches, "expected %d batches, got %d", tt.batches, stat.Batches)
+			assert.Equal(t, 4, stat.Accepted, "expected 4 accepted locations, got %d", stat.Accepted)
+			assert.Equal(t, 2, stat.Discarded, "expected 2 discarded locations (invalid & duplicate), got %d", stat.Discarded)
+			assert.Equal(t, model.WriteStat{Inserted: 4}, stat.WriteStat, "expected every accepted location to be inserted, got %#v", stat.WriteStat)
 		})
 	}
 }
+
+func TestCSVIngestor_IngestConcurrently(t *testing.T) {
+	ctx := context.Background()
+	data := strings.Builder{}
+	data.WriteString(csv_header + "\n")
+	for i := 0; i < 5000; i++ {
+		ip := fmt.Sprintf("10.0.%d.%d", (i%3000)/256, (i%3000)%256)
+		if i%7 == 0 {
+			ip = "bogus"
+		}
+		data.WriteString(fmt.Sprintf("%s,NL,Netherlands,city-%d,52.3675734,4.9041389,%d\n", ip, i, i))
+	}
+	ingest := func(opts IngestOptions) (*model.Stat, internal.Store) {
+		conn, err := mock.New()
+		assert.Nil(t, err, "NewMockConnection() failed, expected no error, got %v", err)
+		stat, err := NewCSVIngestor(conn, strings.NewReader(data.String()), opts).Ingest(ctx)
+		assert.Nil(t, err, "Ingest() failed, expected no error, got %v", err)
+		return stat, conn
+	}
+	write := model.WriteOptions{OnConflict: model.ConflictUpdate}
+	want, sequential := ingest(IngestOptions{Write: write, Validators: 1, Writers: 1, BatchSize: 100})
+
+	tests := []struct {
+		name string
+		opts IngestOptions
+	}{
+		{name: "many validators should not change the outcome", opts: IngestOptions{Write: write, Validators: 8, Writers: 1, BatchSize: 100}},
+		{name: "many writers should not change the outcome", opts: IngestOptions{Write: write, Validators: 8, Writers: 4, BatchSize: 100}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, conn := ingest(tt.opts)
+			assert.Equal(t, want.Accepted, got.Accepted, "expected %d accepted locations, got %d", want.Accepted, got.Accepted)
+			assert.Equal(t, want.Discarded, got.Discarded, "expected %d discarded locations, got %d", want.Discarded, got.Discarded)
+			assert.Equal(t, want.WriteStat, got.WriteStat, "expected write stat %#v, got %#v", want.WriteStat, got.WriteStat)
+			for _, ip := range []string{"10.0.0.1", "10.0.5.200", "10.0.11.183"} {
+				wanted, err := sequential.Get(ctx, ip)
+				assert.Nil(t, err, "Get() failed, expected no error, got %v", err)
+				location, err := conn.Get(ctx, ip)
+				assert.Nil(t, err, "Get() failed, expected no error, got %v", err)
+				assert.Equal(t, wanted.City, location.City, "expected the first duplicate of %v to win, wanted %v, got %v", ip, wanted.City, location.City)
+			}
+		})
+	}
+}
+
+func TestCSVIngestor_IngestFailure(t *testing.T) {
+	ctx := context.Background()
+	conn, err := mock.New()
+	assert.Nil(t, err, "NewMockConnection() failed, expected no error, got %v", err)
+	data := strings.Builder{}
+	data.WriteString(csv_header + "\n")
+	for i := 0; i < 3000; i++ {
+		data.WriteString(fmt.Sprintf("10.0.%d.%d,NL,Netherlands,Amsterdam,52.3675734,4.9041389,\n", i/256, i%256))
+	}
+	_, err = conn.BulkCreate(ctx, []model.Location{{IPAddress: "10.0.11.183", Network: "10.0.11.183/32", CountryCode: "NL", Country: "Netherlands", City: "Amsterdam"}}, model.WriteOptions{})
+	assert.Nil(t, err, "BulkCreate() failed, expected no error, got %v", err)
+
+	// a location already stored makes one writer fail, which must stop the whole ingestion
+	opts := IngestOptions{Write: model.WriteOptions{OnConflict: model.ConflictFail}, Validators: 4, Writers: 3, BatchSize: 10}
+	stat, err := NewCSVIngestor(conn, strings.NewReader(data.String()), opts).Ingest(ctx)
+	assert.ErrorIs(t, err, utils.ErrConflict, "expected error %v, got %v", utils.ErrConflict, err)
+	assert.Nil(t, stat, "expected nil stat, got %#v", stat)
+	_, err = conn.Get(ctx, "10.0.0.1")
+	assert.ErrorIs(t, err, utils.ErrNotFound, "expected error %v, nothing must be served, got %v", utils.ErrNotFound, err)
+}
+
+func TestCSVIngestor_IngestRejects(t *testing.T) {
+	ctx := context.Background()
+	conn, err := mock.New()
+	assert.Nil(t, err, "NewMockConnection() failed, expected no error, got %v", err)
+	rejects := strings.Builder{}
+	c := NewCSVIngestor(conn, strings.NewReader(csv_header+"\n"+
+		"200.106.141.15,SI,Nepal,DuBuquemouth,-84.87503094689836,7.206435933364332,7823011346\n"+
+		"200.106.141.tyr,SI,Nepal,DuBuquemouth,-84.87503094689836,7.206435933364332,7823011346\n"+
+		"160.103.7.140,CZ,Nicaragua,,-68.31023296602508,-37.62435199624531,7301823115\n"+
+		"70.95.73.73,TL,Saudi Arabia,Gradymouth,north,-86.05920084416894,2559997162\n"+
+		"::ffff:200.106.141.15,SI,Nepal,DuBuquemouth,-84.87503094689836,7.206435933364332,7823011346\n"+
+		"70.95.73.73,TL,Saudi Arabia\n"), IngestOptions{Rejects: &rejects, Validators: 2})
+	stat, err := c.Ingest(ctx)
+	assert.Nil(t, err, "Ingest() failed, expected no error, got %v", err)
+	assert.Equal(t, 1, stat.Accepted, "expected 1 accepted location, got %d", stat.Accepted)
+	assert.Equal(t, 5, stat.Discarded, "expected 5 discarded locations, got %d", stat.Discarded)
+	assert.Equal(t, 1, stat.Duplicates, "expected 1 duplicate, got %d", stat.Duplicates)
+	assert.Equal(t, map[model.RejectReason]int{
+		model.RejectIPAddress:   1,
+		model.RejectCity:        1,
+		model.RejectLatitude:    1,
+		model.RejectDuplicate:   1,
+		model.RejectColumnCount: 1,
+	}, stat.DiscardedBy, "discarded rows must be broken down by reason")
+	assert.Equal(t, map[string]int{"ip_address": 1, "city": 1, "latitude": 1}, stat.DiscardedColumns, "discarded rows must be broken down by column")
+	assert.Equal(t, "line,reason,"+csv_header+"\n"+
+		"3,bad_ip_address,200.106.141.tyr,SI,Nepal,DuBuquemouth,-84.87503094689836,7.206435933364332,7823011346\n"+
+		"4,empty_city,160.103.7.140,CZ,Nicaragua,,-68.31023296602508,-37.62435199624531,7301823115\n"+
+		"5,bad_latitude,70.95.73.73,TL,Saudi Arabia,Gradymouth,north,-86.05920084416894,2559997162\n"+
+		"6,duplicate,::ffff:200.106.141.15,SI,Nepal,DuBuquemouth,-84.87503094689836,7.206435933364332,7823011346\n"+
+		"7,bad_column_count,70.95.73.73,TL,Saudi Arabia\n", rejects.String(), "rejects must list every discarded row in file order")
+
+	// a failed ingestion still writes out the rows it rejected
+	rejects.Reset()
+	_, err = NewCSVIngestor(conn, strings.NewReader(csv_header+"\n"+
+		"160.103.7.140,CZ,Nicaragua,,-68.31023296602508,-37.62435199624531,7301823115\n"+
+		"200.106.141.15,SI,Nepal,DuBuquemouth,-84.87503094689836,7.206435933364332,7823011346\n"), IngestOptions{
+		Rejects: &rejects, Write: model.WriteOptions{OnConflict: model.ConflictFail}}).Ingest(ctx)
+	assert.ErrorIs(t, err, utils.ErrConflict, "expected error %v, got %v", utils.ErrConflict, err)
+	assert.Equal(t, "line,reason,"+csv_header+"\n"+
+		"2,empty_city,160.103.7.140,CZ,Nicaragua,,-68.31023296602508,-37.62435199624531,7301823115\n", rejects.String(), "rejects must be written out when the ingestion fails")
+}
+
+func TestCSVIngestor_IngestDuplicates(t *testing.T) {
+	ctx := context.Background()
+	data := csv_header + "\n" +
+		"200.106.141.15,SI,Nepal,DuBuquemouth,-84.87503094689836,7.206435933364332,7823011346\n" +
+		"200.106.141.15,SI,Nepal,Gradymouth,-84.87503094689836,7.206435933364332,7823011346\n" +
+		"200.106.141.15,SI,Nepal,Gradymouth,-84.87503094689836,7.206435933364332,7823011346\n" +
+		"160.103.7.140,CZ,Nicaragua,New Neva,-68.31023296602508,-37.62435199624531,7301823115\n" +
+		"160.103.7.140,CZ,Nicaragua,New Neva,-68.31023296602508,-37.62435199624531,7301823115\n" +
+		"70.95.73.73,TL,Saudi Arabia,Gradymouth,-49.16675918861615,-86.05920084416894,2559997162\n"
+	tests := []struct {
+		name        string
+		policy      DuplicatePolicy
+		seekable    bool
+		city        string
+		accepted    int
+		duplicates  int
+		conflicting int
+	}{
+		{name: "first row should win", policy: DuplicateFirst, seekable: true, city: "DuBuquemouth", accepted: 3, duplicates: 1, conflicting: 2},
+		{name: "last row should win", policy: DuplicateLast, seekable: true, city: "Gradymouth", accepted: 3, duplicates: 2, conflicting: 1},
+		{name: "majority should win", policy: DuplicateMajority, seekable: true, city: "Gradymouth", accepted: 3, duplicates: 2, conflicting: 1},
+		{name: "majority should win reading a stream", policy: DuplicateMajority, city: "Gradymouth", accepted: 3, duplicates: 2, conflicting: 1},
+		{name: "conflicting rows should all be rejected", policy: DuplicateRejectConflicting, accepted: 2, duplicates: 1, conflicting: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := mock.New()
+			assert.Nil(t, err, "NewMockConnection() failed, expected no error, got %v", err)
+			var r io.Reader = strings.NewReader(data)
+			if !tt.seekable {
+				r = io.MultiReader(r)
+			}
+			stat, err := NewCSVIngestor(conn, r, IngestOptions{Duplicates: tt.policy, Validators: 2}).Ingest(ctx)
+			assert.Nil(t, err, "Ingest() failed, expected no error, got %v", err)
+			assert.Equal(t, tt.accepted, stat.Accepted, "expected %d accepted locations, got %d", tt.accepted, stat.Accepted)
+			assert.Equal(t, tt.duplicates, stat.Duplicates, "expected %d duplicates, got %d", tt.duplicates, stat.Duplicates)
+			assert.Equal(t, tt.conflicting, stat.ConflictingDuplicates, "expected %d conflicting duplicates, got %d", tt.conflicting, stat.ConflictingDuplicates)
+			got, err := conn.Get(ctx, "200.106.141.15")
+			if tt.city == "" {
+				assert.ErrorIs(t, err, utils.ErrNotFound, "expected error %v, got %v", utils.ErrNotFound, err)
+				return
+			}
+			assert.Nil(t, err, "Get() failed, expected no error, got %v", err)
+			assert.Equal(t, tt.city, got.City, "city must match, wanted %v, got %v", tt.city, got.City)
+		})
+	}
+
+	conn, err := mock.New()
+	assert.Nil(t, err, "NewMockConnection() failed, expected no error, got %v", err)
+	_, err = NewCSVIngestor(conn, strings.NewReader(data), IngestOptions{Duplicates: "random"}).Ingest(ctx)
+	assert.NotNil(t, err, "expected unknown duplicate policy to fail, got nil")
+
+	// a host & its /32 network are the same network
+	stat, err := NewCSVIngestor(conn, strings.NewReader(csv_header+"\n"+
+		"200.106.141.15,SI,Nepal,DuBuquemouth,-84.87503094689836,7.206435933364332,7823011346\n"+
+		"200.106.141.15/32,SI,Nepal,DuBuquemouth,-84.87503094689836,7.206435933364332,7823011346\n"), IngestOptions{}).Ingest(ctx)
+	assert.Nil(t, err, "Ingest() failed, expected no error, got %v", err)
+	assert.Equal(t, 1, stat.Duplicates, "expected the /32 network to duplicate its host, got %d duplicates", stat.Duplicates)
+	_, err = NewCSVIngestor(conn, strings.NewReader(csv_header+"\n"+
+		"200.106.141.15/32,SI,Nepal,DuBuquemouth,-84.87503094689836,7.206435933364332,7823011346\n"), IngestOptions{Write: model.WriteOptions{OnConflict: model.ConflictFail}}).Ingest(ctx)
+	assert.ErrorIs(t, err, utils.ErrConflict, "expected the /32 network to conflict with its stored host, got %v", err)
+
+	// beyond the limit, first leaves duplicates to the store & any other policy fails
+	conn, err = mock.New()
+	assert.Nil(t, err, "NewMockConnection() failed, expected no error, got %v", err)
+	stat, err = NewCSVIngestor(conn, strings.NewReader(data), IngestOptions{DuplicatesLimit: 1}).Ingest(ctx)
+	assert.Nil(t, err, "Ingest() failed, expected no error, got %v", err)
+	assert.Equal(t, 4, stat.Accepted, "expected the duplicates of the tracked network only to be discarded, got %d accepted", stat.Accepted)
+	assert.Equal(t, 3, stat.Untracked, "expected 3 untracked rows, got %d", stat.Untracked)
+	assert.Equal(t, model.WriteStat{Inserted: 3, Skipped: 1}, stat.WriteStat, "expected the store to skip the untracked duplicate, got %#v", stat.WriteStat)
+	_, err = NewCSVIngestor(conn, strings.NewReader(data), IngestOptions{Duplicates: DuplicateLast, DuplicatesLimit: 2}).Ingest(ctx)
+	assert.NotNil(t, err, "expected too many networks to fail, got nil")
+}
+
+func TestCSVIngestor_IngestDryRun(t *testing.T) {
+	ctx := context.Background()
+	data := csv_header + "\n" +
+		"200.106.141.15,SI,Nepal,DuBuquemouth,-84.87503094689836,7.206435933364332,7823011346\n" +
+		"200.106.141.15,SI,Nepal,Gradymouth,-84.87503094689836,7.206435933364332,7823011346\n" +
+		"160.103.7.140,CZ,Nicaragua,,-68.31023296602508,-37.62435199624531,7301823115\n" +
+		"70.95.73.73,TL,Saudi Arabia,Gradymouth,-49.16675918861615,-86.05920084416894,2559997162\n"
+	conn, err := mock.New()
+	assert.Nil(t, err, "NewMockConnection() failed, expected no error, got %v", err)
+	want, err := NewCSVIngestor(conn, strings.NewReader(data), IngestOptions{Duplicates: DuplicateLast, Validators: 2}).Ingest(ctx)
+	assert.Nil(t, err, "Ingest() failed, expected no error, got %v", err)
+
+	// a dry run needs no store, yet accounts for every row (& rejects it) the way an ingestion does
+	rejects := strings.Builder{}
+	got, err := NewCSVIngestor(nil, strings.NewReader(data), IngestOptions{Duplicates: DuplicateLast, Validators: 2, Writers: 2, Rejects: &rejects, DryRun: true}).Ingest(ctx)
+	assert.Nil(t, err, "Ingest() failed, expected no error, got %v", err)
+	assert.Equal(t, want.Accepted, got.Accepted, "expected %d accepted locations, got %d", want.Accepted, got.Accepted)
+	assert.Equal(t, want.Discarded, got.Discarded, "expected %d discarded locations, got %d", want.Discarded, got.Discarded)
+	assert.Equal(t, want.DiscardedBy, got.DiscardedBy, "discarded rows must be broken down by reason")
+	assert.Equal(t, want.ConflictingDuplicates, got.ConflictingDuplicates, "expected %d conflicting duplicates, got %d", want.ConflictingDuplicates, got.ConflictingDuplicates)
+	assert.Zero(t, got.Dataset, "expected no dataset, got %d", got.Dataset)
+	assert.Equal(t, "line,reason,"+csv_header+"\n"+
+		"2,conflicting_duplicate,200.106.141.15,SI,Nepal,DuBuquemouth,-84.87503094689836,7.206435933364332,7823011346\n"+
+		"4,empty_city,160.103.7.140,CZ,Nicaragua,,-68.31023296602508,-37.62435199624531,7301823115\n", rejects.String(), "rejects must list every discarded row in file order")
+
+	// nothing gets written to a store given along
+	conn, err = mock.New()
+	assert.Nil(t, err, "NewMockConnection() failed, expected no error, got %v", err)
+	_, err = NewCSVIngestor(conn, strings.NewReader(data), IngestOptions{DryRun: true}).Ingest(ctx)
+	assert.Nil(t, err, "Ingest() failed, expected no error, got %v", err)
+	_, err = conn.Get(ctx, "70.95.73.73")
+	assert.ErrorIs(t, err, utils.ErrNotFound, "expected error %v, nothing must be written, got %v", utils.ErrNotFound, err)
+	datasets, err := conn.Datasets(ctx)
+	assert.Nil(t, err, "Datasets() failed, expected no error, got %v", err)
+	assert.Len(t, datasets, 1, "expected no new dataset, got %v", datasets)
+
+	// a dry run can't be checkpointed
+	_, err = NewCSVIngestor(nil, strings.NewReader(data), IngestOptions{DryRun: true, Resume: true}).Ingest(ctx)
+	assert.NotNil(t, err, "expected a resumed dry run to fail, got nil")
+}
+
+func TestCSVIngestor_IngestProgress(t *testing.T) {
+	ctx := context.Background()
+	data := strings.Builder{}
+	data.WriteString(csv_header + "\n")
+	for i := 0; i < 2500; i++ {
+		data.WriteString(fmt.Sprintf("10.0.%d.%d,NL,Netherlands,Amsterdam,52.3675734,4.9041389,\n", i/256, i%256))
+	}
+	data.WriteString("10.0.0.0,NL,Netherlands,,52.3675734,4.9041389,\n")
+	size := int64(data.Len())
+	tests := []struct {
+		name       string
+		policy     DuplicatePolicy
+		seekable   bool
+		read       int
+		size       int64
+		scanReport bool
+	}{
+		{name: "progress should be reported out of the file size", policy: DuplicateFirst, seekable: true, read: 2501, size: size},
+		{name: "progress should be reported without a size reading a stream", policy: DuplicateFirst, read: 2501},
+		{name: "progress should span both passes when scanning for duplicates", policy: DuplicateLast, seekable: true, read: 2 * 2501, size: 2 * size, scanReport: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := mock.New()
+			assert.Nil(t, err, "NewMockConnection() failed, expected no error, got %v", err)
+			var r io.Reader = strings.NewReader(data.String())
+			if !tt.seekable {
+				r = io.MultiReader(r)
+			}
+			reports := make(chan model.Progress, 100)
+			opts := IngestOptions{Duplicates: tt.policy, Validators: 2, Progress: SendProgress(reports), ProgressInterval: time.Nanosecond}
+			stat, err := NewCSVIngestor(conn, r, opts).Ingest(ctx)
+			assert.Nil(t, err, "Ingest() failed, expected no error, got %v", err)
+			close(reports)
+
+			var last model.Progress
+			scanned := false
+			for p := range reports {
+				assert.False(t, last.Done, "expected no report after the last one, got %#v", p)
+				assert.GreaterOrEqual(t, p.Read, last.Read, "rows read must only grow, got %d after %d", p.Read, last.Read)
+				assert.GreaterOrEqual(t, p.Bytes, last.Bytes, "bytes consumed must only grow, got %d after %d", p.Bytes, last.Bytes)
+				assert.Equal(t, tt.size, p.Size, "expected size %d, got %d", tt.size, p.Size)
+				if tt.size == 0 {
+					assert.Zero(t, p.ETA, "expected no ETA without a size, got %v", p.ETA)
+				}
+				scanned = scanned || p.Scanning
+				last = p
+			}
+			assert.True(t, last.Done, "expected the last report to be done, got %#v", last)
+			assert.Equal(t, tt.scanReport, scanned, "expected scanning reports %v, got %v", tt.scanReport, scanned)
+			assert.Equal(t, tt.read, last.Read, "expected %d rows read, got %d", tt.read, last.Read)
+			assert.Equal(t, stat.Accepted, last.Accepted, "expected %d accepted locations, got %d", stat.Accepted, last.Accepted)
+			assert.Equal(t, stat.Discarded, last.Discarded, "expected %d discarded locations, got %d", stat.Discarded, last.Discarded)
+			if tt.size > 0 {
+				assert.Equal(t, tt.size, last.Bytes, "expected every byte consumed, got %d", last.Bytes)
+			}
+			assert.Zero(t, last.ETA, "expected no time left once done, got %v", last.ETA)
+		})
+	}
+}
+
+func TestCSVIngestor_IngestSync(t *testing.T) {
+	ctx := context.Background()
+	conn, err := mock.New()
+	assert.Nil(t, err, "NewMockConnection() failed, expected no error, got %v", err)
+	_, err = NewCSVIngestor(conn, strings.NewReader(csv_header+"\n"+
+		"200.106.141.15,SI,Nepal,DuBuquemouth,-84.87503094689836,7.206435933364332,7823011346\n"+
+		"160.103.7.140,CZ,Nicaragua,New Neva,-68.31023296602508,-37.62435199624531,7301823115\n"+
+		"70.95.73.73,TL,Saudi Arabia,Gradymouth,-49.16675918861615,-86.05920084416894,2559997162\n"), IngestOptions{}).Ingest(ctx)
+	assert.Nil(t, err, "Ingest() failed, expected no error, got %v", err)
+
+	// 200.106.141.15 is unchanged, 160.103.7.140 moved, 125.159.20.54 is new & 70.95.73.73 got withdrawn
+	dump := csv_header + "\n" +
+		"200.106.141.15,SI,Nepal,DuBuquemouth,-84.87503094689836,7.206435933364332,7823011346\n" +
+		"160.103.7.140,CZ,Nicaragua,Gradymouth,-68.31023296602508,-37.62435199624531,7301823115\n" +
+		"125.159.20.54,LI,Guyana,Port Karson,-78.2274228596799,-163.26218895343357,1337885276\n"
+	opts := IngestOptions{Mode: ModeSync, Write: model.WriteOptions{OnConflict: model.ConflictFail}, Writers: 2}
+	stat, err := NewCSVIngestor(conn, strings.NewReader(dump), opts).Ingest(ctx)
+	assert.Nil(t, err, "Ingest() failed, expected no error, got %v", err)
+	assert.Equal(t, model.WriteStat{Inserted: 1, Updated: 1, Skipped: 1, Deleted: 1}, stat.WriteStat, "expected the delta against the served locations, got %#v", stat.WriteStat)
+	_, err = conn.Get(ctx, "70.95.73.73")
+	assert.ErrorIs(t, err, utils.ErrNotFound, "expected error %v, the withdrawn location must be deleted, got %v", utils.ErrNotFound, err)
+	got, err := conn.Get(ctx, "160.103.7.140")
+	assert.Nil(t, err, "Get() failed, expected no error, got %v", err)
+	assert.Equal(t, "Gradymouth", got.City, "the changed location must be updated, wanted %v, got %v", "Gradymouth", got.City)
+
+	// syncing the same dump again changes nothing
+	stat, err = NewCSVIngestor(conn, strings.NewReader(dump), opts).Ingest(ctx)
+	assert.Nil(t, err, "Ingest() failed, expected no error, got %v", err)
+	assert.Equal(t, model.WriteStat{Skipped: 3}, stat.WriteStat, "expected no delta, got %#v", stat.WriteStat)
+
+	// discarded rows whose ip address parses still hold their location, only the unparsable one holds none
+	discarded := csv_header + "\n" +
+		"200.106.141.15,SI,Nepal,DuBuquemouth,not-a-latitude,7.206435933364332,7823011346\n" +
+		"160.103.7.140,CZ,Nicaragua,Gradymouth,-68.31023296602508,-37.62435199624531,7301823115\n" +
+		"160.103.7.140,CZ,Nicaragua,New Neva,-68.31023296602508,-37.62435199624531,7301823115\n" +
+		"125.159.20.54,LI,Guyana\n" +
+		"not-an-ip,TL,Saudi Arabia,Gradymouth,-49.16675918861615,-86.05920084416894,2559997162\n" +
+		"70.95.73.73,TL,Saudi Arabia,Gradymouth,-49.16675918861615,-86.05920084416894,2559997162\n"
+	opts.Duplicates = DuplicateRejectConflicting
+	stat, err = NewCSVIngestor(conn, strings.NewReader(discarded), opts).Ingest(ctx)
+	assert.Nil(t, err, "Ingest() failed, expected no error, got %v", err)
+	assert.Equal(t, 5, stat.Discarded, "expected 5 discarded rows, got %d", stat.Discarded)
+	assert.Equal(t, model.WriteStat{Inserted: 1}, stat.WriteStat, "expected the locations of discarded rows kept, got %#v", stat.WriteStat)
+	for _, ip := range []string{"200.106.141.15", "160.103.7.140", "125.159.20.54"} {
+		_, err = conn.Get(ctx, ip)
+		assert.Nil(t, err, "Get(%s) failed, the location of a discarded row must be kept, got %v", ip, err)
+	}
+
+	// an empty or entirely invalid dump must not wipe the served locations out
+	for _, empty := range []string{csv_header + "\n", csv_header + "\nnot-an-ip,TL,Saudi Arabia,Gradymouth,-49.16675918861615,-86.05920084416894,2559997162\n"} {
+		_, err = NewCSVIngestor(conn, strings.NewReader(empty), IngestOptions{Mode: ModeSync}).Ingest(ctx)
+		assert.NotNil(t, err, "expected syncing a dump without any accepted location to fail, got nil")
+		for _, ip := range []string{"200.106.141.15", "160.103.7.140", "125.159.20.54"} {
+			_, err = conn.Get(ctx, ip)
+			assert.Nil(t, err, "Get(%s) failed, the locations must be kept, got %v", ip, err)
+		}
+	}
+
+	_, err = NewCSVIngestor(conn, strings.NewReader(dump), IngestOptions{Mode: ModeSync, Resume: true}).Ingest(ctx)
+	assert.NotNil(t, err, "expected a resumed sync to fail, got nil")
+	_, err = NewCSVIngestor(conn, strings.NewReader(dump), IngestOptions{Mode: "replace"}).Ingest(ctx)
+	assert.NotNil(t, err, "expected unknown mode to fail, got nil")
+}
+
+func Test_newLayout(t *testing.T) {
+	cfg := model.Columns{IPAddress: []string{"IP"}, City: []string{"town", "Locality"}}
+	tests := []struct {
+		name    string
+		header  string
+		index   [columns]int
+		wantErr bool
+	}{
+		{name: "default header should match in order", header: csv_header, index: [columns]int{0, 1, 2, 3, 4, 5, 6}},
+		{name: "network header should match", header: "ip_network,country_code,country,city,latitude,longitude,mystery_value", index: [columns]int{0, 1, 2, 3, 4, 5, 6}},
+		{name: "case, whitespace & separators should not matter", header: " Longitude ,LATITUDE,City,Country,Country Code,ip-address,Mystery_Value", index: [columns]int{5, 4, 3, 2, 1, 0, 6}},
+		{name: "aliases should match & extra columns be ignored", header: "source,Locality,ip,country_code,country,latitude,longitude", index: [columns]int{2, 3, 4, 1, 5, 6, -1}},
+		{name: "missing column should fail", header: "ip,country_code,country,latitude,longitude", wantErr: true},
+		{name: "column named twice should fail", header: "ip,ip_address,country_code,country,city,latitude,longitude", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := newLayout(strings.Split(tt.header, ","), cfg)
+			if tt.wantErr {
+				assert.NotNil(t, err, "expected newLayout() to fail, got %#v", got)
+				return
+			}
+			assert.Nil(t, err, "newLayout() failed, expected no error, got %v", err)
+			assert.Equal(t, tt.index, got.index, "column indexes must match")
+		})
+	}
+
+	_, err := newLayout(strings.Split(csv_header, ","), model.Columns{Country: []string{"city"}})
+	assert.NotNil(t, err, "expected an alias naming two columns to fail, got nil")
+}
+
+func TestCSVIngestor_IngestColumns(t *testing.T) {
+	ctx := context.Background()
+	conn, err := mock.New()
+	assert.Nil(t, err, "NewMockConnection() failed, expected no error, got %v", err)
+	c := NewCSVIngestor(conn, strings.NewReader("Town,IP,Country Code,Country,Latitude,Longitude,source\n"+
+		"DuBuquemouth,200.106.141.15,SI,Nepal,-84.87503094689836,7.206435933364332,feed-a\n"), IngestOptions{
+		Columns: model.Columns{IPAddress: []string{"ip"}, City: []string{"town"}},
+	})
+	stat, err := c.Ingest(ctx)
+	assert.Nil(t, err, "Ingest() failed, expected no error, got %v", err)
+	assert.Equal(t, 1, stat.Accepted, "expected 1 accepted location, got %d", stat.Accepted)
+	got, err := conn.Get(ctx, "200.106.141.15")
+	assert.Nil(t, err, "Get() failed, expected no error, got %v", err)
+	assert.Equal(t, "DuBuquemouth", got.City, "city must match, wanted %v, got %v", "DuBuquemouth", got.City)
+	assert.Nil(t, got.MysteryValue, "expected no mystery value, got %v", got.MysteryValue)
+}
@@ -0,0 +1,212 @@
+package service
+
+import (
+	"fmt"
+	"geolocation/internal/model"
+	"hash/fnv"
+	"io"
+	"os"
+)
+
+// DuplicatePolicy picks which of the rows sharing an ip address (or network) within a file gets ingested
+type DuplicatePolicy string
+
+// DefaultDuplicatesLimit is the most networks duplicates are tracked for, unless configured otherwise.
+// Tracking takes roughly 100 bytes per network (more for policies other than first)
+const DefaultDuplicatesLimit = 1 << 22
+
+const (
+	// DuplicateFirst ingests the first row
+	DuplicateFirst DuplicatePolicy = "first"
+	// DuplicateLast ingests the last row
+	DuplicateLast DuplicatePolicy = "last"
+	// DuplicateRejectConflicting ingests none of the rows as soon as they disagree, the first one otherwise
+	DuplicateRejectConflicting DuplicatePolicy = "reject-all-conflicting"
+	// DuplicateMajority ingests the data most rows agree on, the earliest one on a tie
+	DuplicateMajority DuplicatePolicy = "majority"
+)
+
+// position is where a row sits among every input of an ingestion
+type position struct {
+	input int
+	line  int
+}
+
+// before reports whether p comes before o
+func (p position) before(o position) bool {
+	return p.input < o.input || (p.input == o.input && p.line < o.line)
+}
+
+// variant is one version of the data an ip address is given within the ingested inputs
+type variant struct {
+	fingerprint uint64
+	count       int
+	first       position
+}
+
+// occurrences are the rows sharing an ip address, grouped by variant
+type occurrences struct {
+	variants        []variant
+	last            position
+	lastFingerprint uint64
+}
+
+// winner is the row ingested for a duplicated ip address, unless none is
+type winner struct {
+	none        bool
+	at          position
+	fingerprint uint64
+}
+
+// duplicates settles which of the rows sharing a network (a host being its /32 or /128) gets ingested.
+// The first row can be settled right away, any other policy needs to see every row first (see scan & decide).
+// Memory grows with the number of networks tracked, which is bounded by limit
+type duplicates struct {
+	policy DuplicatePolicy
+	limit  int
+	// seen holds the fingerprint of the first row of every network (first policy), up to limit networks
+	seen map[string]uint64
+	// untracked is the number of rows of networks beyond limit, left for the store to resolve (first policy)
+	untracked int
+	// groups holds the rows of every network, while scanning
+	groups map[string]*occurrences
+	// winners holds the winning row of every duplicated network, once decided
+	winners map[string]winner
+}
+
+// newDuplicates creates duplicates settled by the given policy, first by default,
+// tracking up to limit networks (DefaultDuplicatesLimit by default)
+func newDuplicates(policy DuplicatePolicy, limit int) (*duplicates, error) {
+	if limit <= 0 {
+		limit = DefaultDuplicatesLimit
+	}
+	switch policy {
+	case "", DuplicateFirst:
+		return &duplicates{policy: DuplicateFirst, limit: limit, seen: map[string]uint64{}}, nil
+	case DuplicateLast, DuplicateRejectConflicting, DuplicateMajority:
+		return &duplicates{policy: policy, limit: limit, groups: map[string]*occurrences{}}, nil
+	}
+	return nil, fmt.Errorf("invalid duplicate policy %q, only %s, %s, %s & %s are supported", policy, DuplicateFirst, DuplicateLast, DuplicateRejectConflicting, DuplicateMajority)
+}
+
+// needsScan reports whether every row must be scanned (& decided upon) before any can be settled
+func (d *duplicates) needsScan() bool {
+	return d.policy != DuplicateFirst
+}
+
+// scan records a valid row, failing once more than limit networks got scanned
+func (d *duplicates) scan(at position, l model.Location) error {
+	fp := fingerprint(l)
+	o, ok := d.groups[l.Network]
+	if !ok {
+		if len(d.groups) == d.limit {
+			return fmt.Errorf("more than %d distinct networks, too many to settle duplicates by %s (see the duplicates limit)", d.limit, d.policy)
+		}
+		o = &occurrences{}
+		d.groups[l.Network] = o
+	}
+	o.last, o.lastFingerprint = at, fp
+	for i := range o.variants {
+		if o.variants[i].fingerprint == fp {
+			o.variants[i].count++
+			return nil
+		}
+	}
+	o.variants = append(o.variants, variant{fingerprint: fp, count: 1, first: at})
+	return nil
+}
+
+// decide picks the winning row of every duplicated ip address out of the scanned rows
+func (d *duplicates) decide() {
+	d.winners = map[string]winner{}
+	for network, o := range d.groups {
+		if len(o.variants) == 1 && o.variants[0].count == 1 {
+			continue
+		}
+		first := o.variants[0]
+		switch d.policy {
+		case DuplicateLast:
+			d.winners[network] = winner{at: o.last, fingerprint: o.lastFingerprint}
+		case DuplicateRejectConflicting:
+			if len(o.variants) > 1 {
+				d.winners[network] = winner{none: true}
+			} else {
+				d.winners[network] = winner{at: first.first, fingerprint: first.fingerprint}
+			}
+		case DuplicateMajority:
+			best := first
+			for _, v := range o.variants[1:] {
+				if v.count > best.count || (v.count == best.count && v.first.before(best.first)) {
+					best = v
+				}
+			}
+			d.winners[network] = winner{at: best.first, fingerprint: best.fingerprint}
+		}
+	}
+	d.groups = nil
+}
+
+// settle tells whether a valid row gets ingested (an empty reason) or discarded as a duplicate.
+// Rows must be settled in file order. Once limit networks are tracked (first policy), rows of any other network
+// get ingested, leaving their duplicates to the store's conflict policy
+func (d *duplicates) settle(at position, l model.Location) model.RejectReason {
+	fp := fingerprint(l)
+	if d.policy == DuplicateFirst {
+		first, seen := d.seen[l.Network]
+		switch {
+		case !seen && len(d.seen) == d.limit:
+			d.untracked++
+			return ""
+		case !seen:
+			d.seen[l.Network] = fp
+			return ""
+		case first == fp:
+			return model.RejectDuplicate
+		}
+		return model.RejectConflictingDuplicate
+	}
+	w, ok := d.winners[l.Network]
+	switch {
+	case !ok || (!w.none && w.at == at):
+		return ""
+	case !w.none && w.fingerprint == fp:
+		return model.RejectDuplicate
+	}
+	return model.RejectConflictingDuplicate
+}
+
+// fingerprint identifies the data of a location, whichever notation (host or /32) its ip address was given in
+func fingerprint(l model.Location) uint64 {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00%s\x00%v\x00%v\x00%v", l.Network, l.CountryCode, l.Country, l.City, l.Latitude, l.Longitude, l.MysteryValue)
+	return h.Sum64()
+}
+
+// rewindable makes a reader readable twice, seeking back to where it started when possible,
+// spooling what is read the first time into a temporary file otherwise.
+// Returns the reader for the first read, a func rewinding it for the second one & a func releasing it
+func rewindable(r io.Reader) (io.Reader, func() (io.Reader, error), func(), error) {
+	if rs, ok := r.(io.ReadSeeker); ok {
+		start, err := rs.Seek(0, io.SeekCurrent)
+		if err == nil {
+			rewind := func() (io.Reader, error) {
+				_, err := rs.Seek(start, io.SeekStart)
+				return rs, err
+			}
+			return rs, rewind, func() {}, nil
+		}
+	}
+	spool, err := os.CreateTemp("", "geolocation-*.spool")
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	rewind := func() (io.Reader, error) {
+		_, err := spool.Seek(0, io.SeekStart)
+		return spool, err
+	}
+	release := func() {
+		spool.Close()
+		os.Remove(spool.Name())
+	}
+	return io.TeeReader(r, spool), rewind, release, nil
+}
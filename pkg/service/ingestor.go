@@ -0,0 +1,448 @@
+package service
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"geolocation/internal"
+	"geolocation/internal/model"
+	"geolocation/internal/utils"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Ingestor is intended to read valid geolocation data from a file of some format
+// and ingest it in database, every format sharing the same sanitisation & statistics
+type Ingestor interface {
+	Ingest(ctx context.Context) (*model.Stat, error)
+}
+
+// Format names the format of a file to ingest
+type Format string
+
+const (
+	FormatCSV    Format = "csv"
+	FormatTSV    Format = "tsv"
+	FormatNDJSON Format = "ndjson"
+)
+
+// extensions maps the file extensions of every format
+var extensions = map[string]Format{
+	".csv":    FormatCSV,
+	".tsv":    FormatTSV,
+	".tab":    FormatTSV,
+	".ndjson": FormatNDJSON,
+	".jsonl":  FormatNDJSON,
+}
+
+// FormatOf tells the format of a file by its extension
+func FormatOf(file string) (Format, error) {
+	if f, ok := extensions[strings.ToLower(filepath.Ext(file))]; ok {
+		return f, nil
+	}
+	return "", fmt.Errorf("unknown format of %q, only csv, tsv (or tab) & ndjson (or jsonl) files are supported", file)
+}
+
+// NewIngestor creates new instance of the Ingestor reading the given format
+func NewIngestor(f Format, store internal.Store, r io.Reader, opts IngestOptions) (Ingestor, error) {
+	switch f {
+	case FormatCSV:
+		return NewCSVIngestor(store, r, opts), nil
+	case FormatTSV:
+		return NewTSVIngestor(store, r, opts), nil
+	case FormatNDJSON:
+		return NewNDJSONIngestor(store, r, opts), nil
+	}
+	return nil, fmt.Errorf("invalid format %q, only csv, tsv & ndjson are supported", f)
+}
+
+// formats reads every format
+var formats = map[Format]format{
+	FormatCSV:    csvFormat{comma: ','},
+	FormatTSV:    csvFormat{comma: '\t'},
+	FormatNDJSON: ndjsonFormat{},
+}
+
+// FilesIngestor is intended to read valid geolocation data from several files (e.g. the members of an archive, see Unpack),
+// each one of its own format, and ingest it in database
+type FilesIngestor struct {
+	store internal.Store
+	files []File
+	f     Format
+	opts  IngestOptions
+}
+
+// NewFilesIngestor creates new instance of FilesIngestor,
+// every file is read in the given format, or the one told by its name (see FormatOf) when empty
+func NewFilesIngestor(store internal.Store, files []File, f Format, opts IngestOptions) *FilesIngestor {
+	return &FilesIngestor{store, files, f, opts}
+}
+
+// Ingest streams every file in order, just like CSVIngestor.Ingest does with a single csv file,
+// into a single dataset which replaces the active one only once every file got loaded
+func (c *FilesIngestor) Ingest(ctx context.Context) (*model.Stat, error) {
+	inputs := make([]input, 0, len(c.files))
+	for _, file := range c.files {
+		f := c.f
+		if f == "" {
+			var err error
+			if f, err = FormatOf(file.Name); err != nil {
+				return nil, err
+			}
+		}
+		format, ok := formats[f]
+		if !ok {
+			return nil, fmt.Errorf("invalid format %q, only csv, tsv & ndjson are supported", f)
+		}
+		inputs = append(inputs, input{name: file.Name, f: format, open: file.Open, size: file.Size})
+	}
+	return ingest(ctx, c.store, inputs, c.opts)
+}
+
+// Mode picks how an ingestion relates to the locations already served
+type Mode string
+
+const (
+	// ModeAppend adds the locations of the dump to the served ones, resolving conflicts as per model.WriteOptions.OnConflict
+	ModeAppend Mode = "append"
+	// ModeSync makes the dataset mirror the dump: new locations get inserted, changed ones updated & absent ones deleted,
+	// a dump without a single accepted location fails rather than deleting every location
+	ModeSync Mode = "sync"
+)
+
+// IngestOptions tune an ingestion, the zero value is a valid default
+type IngestOptions struct {
+	// Write is handed over to the store on every write
+	Write model.WriteOptions
+	// BatchSize is the most locations buffered (per writer) before they get flushed to the store, defaults to DefaultBatchSize
+	BatchSize int
+	// MemoryLimit is the most bytes (roughly) buffered locations may take before they get flushed to the store,
+	// shared among writers, 0 leaves batches bounded by BatchSize only
+	MemoryLimit int
+	// Validators is the number of workers sanitising rows, defaults to the number of CPUs
+	Validators int
+	// Writers is the number of workers writing batches to the store concurrently, defaults to 1
+	Writers int
+	// Columns names the columns of the file, which are otherwise found by their default name (see csv_header)
+	Columns model.Columns
+	// Duplicates picks which of the rows sharing an ip address (or network) gets ingested, defaults to DuplicateFirst
+	Duplicates DuplicatePolicy
+	// DuplicatesLimit is the most networks tracked to settle duplicates, which takes memory for every one of them,
+	// defaults to DefaultDuplicatesLimit. Beyond it, first leaves duplicates to Write.OnConflict (see model.Stat.Untracked)
+	// & any other policy fails
+	DuplicatesLimit int
+	// Mode picks whether the dump gets appended to the served locations (the default) or synced with them,
+	// a synced dump updates conflicting locations regardless of Write.OnConflict & can't be resumed
+	Mode Mode
+	// Checkpoint, when set, names the file (& its checksum, see Checksum) of a single file ingestion,
+	// whose progress then gets recorded in the store after every committed batch (see model.Checkpoint).
+	// The dataset of a failed ingestion is kept, so that it can be resumed
+	Checkpoint *model.Checkpoint
+	// Resume continues the ingestion of the file of Checkpoint right after its last checkpoint, into the same dataset
+	Resume bool
+	// DryRun reads, sanitises & settles duplicates of every row, accounting for them as usual, without touching the store
+	// (which may then be nil), nothing gets written
+	DryRun bool
+	// Rejects, when set, gets every discarded row as csv, prefixed by its line number & the reason it got discarded for
+	Rejects io.Writer
+	// Progress, when set, gets how far the ingestion got every ProgressInterval & once it completed (see SendProgress).
+	// It's called synchronously while rows get settled, so a slow callback slows the ingestion down
+	Progress func(model.Progress)
+	// ProgressInterval is the least time between 2 progress reports, defaults to DefaultProgressInterval
+	ProgressInterval time.Duration
+}
+
+// format reads the rows of a file
+type format interface {
+	// open reads the header of a file (if any) & finds every column (see newLayout),
+	// returning a func reading its rows after from (seeking when r is an io.Seeker) along with the header, nil for an empty file
+	open(r io.Reader, cfg model.Columns, from mark) (func() (row, error), []string, *layout, error)
+}
+
+// open opens a file of the given format, unless ctx is done
+func open(ctx context.Context, f format, r io.Reader, cfg model.Columns, from mark) (func() (row, error), []string, *layout, error) {
+	select {
+	case <-ctx.Done():
+		return nil, nil, nil, ctx.Err()
+	default:
+	}
+	return f.open(r, cfg, from)
+}
+
+// input is a file to ingest in a given format, of the given size (0 when unknown)
+type input struct {
+	name string
+	f    format
+	open func() (io.ReadCloser, error)
+	size int64
+}
+
+// single turns a reader into the only input of an ingestion, none for a nil reader
+func single(r io.Reader, f format) []input {
+	if r == nil {
+		return nil
+	}
+	return []input{{f: f, open: func() (io.ReadCloser, error) { return nopCloser(r), nil }, size: sizeOf(r)}}
+}
+
+// nopCloser is io.NopCloser keeping r seekable (see rewindable)
+func nopCloser(r io.Reader) io.ReadCloser {
+	if rs, ok := r.(io.ReadSeeker); ok {
+		return readSeekNopCloser{rs}
+	}
+	return io.NopCloser(r)
+}
+
+type readSeekNopCloser struct {
+	io.ReadSeeker
+}
+
+func (readSeekNopCloser) Close() error {
+	return nil
+}
+
+// ingest reads the rows of every input, one after the other, & ingests the valid ones into a single dataset,
+// see CSVIngestor.Ingest
+func ingest(ctx context.Context, store internal.Store, inputs []input, opts IngestOptions) (*model.Stat, error) {
+	// make sure dependencies are intact or fail fast
+	if store == nil && !opts.DryRun {
+		return nil, errors.New("nil store")
+	}
+	if len(inputs) == 0 {
+		return nil, errors.New("nil reader")
+	}
+
+	dups, err := newDuplicates(opts.Duplicates, opts.DuplicatesLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	// resume from the checkpoint of a previous ingestion of the file, or start over
+	var checkpoint *model.Checkpoint
+	var dataset *model.Dataset
+	from := mark{}
+	if opts.DryRun && (opts.Checkpoint != nil || opts.Resume) {
+		return nil, errors.New("a dry run can't be checkpointed nor resumed")
+	}
+	switch opts.Mode {
+	case "", ModeAppend:
+	case ModeSync:
+		// the locations present before the checkpoint are unknown to a resumed ingestion
+		if opts.Resume {
+			return nil, errors.New("a synced ingestion can't be resumed")
+		}
+	default:
+		return nil, fmt.Errorf("invalid mode %q, only %s & %s are supported", opts.Mode, ModeAppend, ModeSync)
+	}
+	if opts.Checkpoint != nil {
+		if len(inputs) > 1 {
+			return nil, errors.New("checkpoints are only recorded for a single file")
+		}
+		if checkpoint, dataset, err = startCheckpoint(ctx, store, *opts.Checkpoint, opts.Resume); err != nil {
+			return nil, err
+		}
+		if dataset != nil {
+			from = mark{checkpoint.Line, checkpoint.Offset}
+		}
+	} else if opts.Resume {
+		return nil, errors.New("nothing to resume without a checkpoint")
+	}
+
+	now := time.Now()
+	s := model.Stat{ResumedAt: from.line}
+	if checkpoint != nil {
+		s.RunID = checkpoint.RunID
+	}
+	var rejects *csv.Writer
+	if opts.Rejects != nil {
+		rejects = csv.NewWriter(opts.Rejects)
+	}
+
+	// report progress out of the size of every input, read twice when scanning for duplicates
+	var size int64
+	for _, in := range inputs {
+		if in.size <= 0 {
+			size = 0
+			break
+		}
+		size += in.size
+	}
+	if dups.needsScan() {
+		size *= 2
+	}
+	progress := newProgress(opts.Progress, opts.ProgressInterval, size)
+
+	readers := make([]io.Reader, len(inputs))
+	closers := make([]io.Closer, len(inputs))
+	defer func() {
+		for _, c := range closers {
+			if c != nil {
+				c.Close()
+			}
+		}
+	}()
+
+	// duplicates can only be settled once every row got scanned, in which case every input is read twice
+	if dups.needsScan() {
+		for i, in := range inputs {
+			rc, err := in.open()
+			if err != nil {
+				return nil, fmt.Errorf("open(%s) failed, err: %w", in.name, err)
+			}
+			closers[i] = rc
+			first, rewind, release, err := rewindable(rc)
+			if err != nil {
+				return nil, err
+			}
+			defer release()
+			read, _, l, err := open(ctx, in.f, first, opts.Columns, mark{})
+			if err != nil {
+				return nil, err
+			}
+			p := newPipeline(store, opts, model.WriteOptions{}, dups, nil)
+			p.input, p.layout, p.scan, p.progress = i, l, true, progress
+			progress.next(in.name, true, 0)
+			if err := p.run(ctx, read, &s); err != nil {
+				return nil, err
+			}
+			if readers[i], err = rewind(); err != nil {
+				return nil, err
+			}
+		}
+		dups.decide()
+	}
+
+	activated := false
+	defer func() {
+		// a checkpointed dataset is kept around to be resumed
+		if dataset != nil && !activated && checkpoint == nil {
+			if err := store.DropDataset(context.Background(), dataset.Version); err != nil {
+				utils.GetLogger().WithFields(logrus.Fields{"dataset": dataset.Version, "err": err}).Error("DropDataset() failed, the dataset of the failed ingestion is left behind")
+			}
+		}
+	}()
+	write := opts.Write
+	if dataset != nil {
+		write.Dataset = dataset.Version
+	}
+	sync := opts.Mode == ModeSync
+	if sync {
+		write.OnConflict = model.ConflictUpdate
+	}
+	for i, in := range inputs {
+		r := readers[i]
+		if r == nil {
+			rc, err := in.open()
+			if err != nil {
+				return nil, fmt.Errorf("open(%s) failed, err: %w", in.name, err)
+			}
+			closers[i], r = rc, rc
+		}
+
+		// check the header & find every column within it upfront or fail fast
+		read, header, l, err := open(ctx, in.f, r, opts.Columns, from)
+		if err != nil {
+			if len(inputs) > 1 {
+				return nil, fmt.Errorf("%s: %w", in.name, err)
+			}
+			return nil, err
+		}
+		if rejects != nil && header != nil && i == 0 {
+			prefix := []string{"line", "reason"}
+			if len(inputs) > 1 {
+				prefix = append([]string{"file"}, prefix...)
+			}
+			if err := rejects.Write(append(prefix, header...)); err != nil {
+				return nil, fmt.Errorf("rejects Write() failed, err: %w", err)
+			}
+		}
+
+		// load into a new dataset, which only gets served once everything has been written
+		if dataset == nil && !opts.DryRun {
+			if dataset, err = store.CreateDataset(ctx); err != nil {
+				return nil, fmt.Errorf("CreateDataset() failed, err: %w", err)
+			}
+			write.Dataset = dataset.Version
+			if checkpoint != nil {
+				checkpoint.Dataset = dataset.Version
+				if err := store.SaveCheckpoint(ctx, *checkpoint); err != nil {
+					return nil, fmt.Errorf("SaveCheckpoint() failed, err: %w", err)
+				}
+			}
+		}
+
+		// read, sanitise & ingest valid locations batch by batch
+		p := newPipeline(store, opts, write, dups, rejects)
+		p.input, p.layout, p.dryRun, p.progress, p.sync = i, l, opts.DryRun, progress, sync
+		progress.next(in.name, false, from.offset)
+		if len(inputs) > 1 {
+			p.name = in.name
+		}
+		if checkpoint != nil {
+			p.from = from
+			p.checkpoint = func(at mark) error {
+				c := *checkpoint
+				c.Line, c.Offset = at.line, at.offset
+				if err := store.SaveCheckpoint(ctx, c); err != nil {
+					return fmt.Errorf("SaveCheckpoint() failed, err: %w", err)
+				}
+				return nil
+			}
+		}
+		started := time.Now()
+		fileStat := model.Stat{Dataset: write.Dataset}
+		untracked := dups.untracked
+		if err := p.run(ctx, read, &fileStat); err != nil {
+			return nil, err
+		}
+		fileStat.Untracked = dups.untracked - untracked
+		fileStat.TimeSpent = time.Since(started)
+		s.Add(fileStat)
+		if len(inputs) > 1 {
+			s.Files = append(s.Files, model.FileStat{Name: in.name, Stat: fileStat})
+		}
+		closers[i].Close()
+		closers[i] = nil
+	}
+
+	if opts.DryRun {
+		progress.finish()
+		s.TimeSpent = time.Since(now)
+		return &s, nil
+	}
+
+	// delete the locations the synced dump no longer holds, unless it holds none at all:
+	// an empty (or entirely invalid) dump is far more likely a broken export than the end of every location
+	if sync {
+		if s.Accepted == 0 {
+			return nil, errors.New("a synced dump without a single accepted location would delete every location, refusing to sync")
+		}
+		deleted, err := store.DeleteAbsent(ctx, write)
+		if err != nil {
+			return nil, fmt.Errorf("DeleteAbsent() failed, err: %w", err)
+		}
+		s.Deleted = deleted
+	}
+
+	// atomically switch over to the new dataset
+	if err := store.ActivateDataset(ctx, dataset.Version); err != nil {
+		return nil, fmt.Errorf("ActivateDataset() failed, err: %w", err)
+	}
+	activated = true
+	s.Dataset = dataset.Version
+	if checkpoint != nil {
+		// best effort, a stale checkpoint can't be resumed anyway as its dataset is active
+		if err := store.DeleteCheckpoint(ctx, checkpoint.File); err != nil {
+			utils.GetLogger().WithFields(logrus.Fields{"file": checkpoint.File, "run": checkpoint.RunID, "err": err}).Error("DeleteCheckpoint() failed, a stale checkpoint is left behind")
+		}
+	}
+	progress.finish()
+
+	s.TimeSpent = time.Since(now)
+	return &s, nil
+}
@@ -0,0 +1,112 @@
+package service
+
+import (
+	"context"
+	"geolocation/internal/model"
+	"geolocation/internal/store/mock"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormatOf(t *testing.T) {
+	tests := []struct {
+		file    string
+		format  Format
+		wantErr bool
+	}{
+		{file: "data_dump.csv", format: FormatCSV},
+		{file: "data/dump.TSV", format: FormatTSV},
+		{file: "dump.tab", format: FormatTSV},
+		{file: "dump.ndjson", format: FormatNDJSON},
+		{file: "dump.jsonl", format: FormatNDJSON},
+		{file: "dump.xlsx", wantErr: true},
+		{file: "dump", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			got, err := FormatOf(tt.file)
+			if tt.wantErr {
+				assert.NotNil(t, err, "expected FormatOf() to fail, got %v", got)
+				return
+			}
+			assert.Nil(t, err, "FormatOf() failed, expected no error, got %v", err)
+			assert.Equal(t, tt.format, got, "format must match, wanted %v, got %v", tt.format, got)
+		})
+	}
+}
+
+func TestNewIngestor(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name        string
+		format      Format
+		data        string
+		accepted    int
+		discarded   int
+		discardedBy map[model.RejectReason]int
+		rejects     string
+	}{
+		{
+			name:   "csv should be ingested",
+			format: FormatCSV,
+			data: csv_header + "\n" +
+				"200.106.141.15,SI,Nepal,DuBuquemouth,-84.87503094689836,7.206435933364332,7823011346\n" +
+				"160.103.7.140,CZ,Nicaragua,,-68.31023296602508,-37.62435199624531,7301823115\n",
+			accepted:    1,
+			discarded:   1,
+			discardedBy: map[model.RejectReason]int{model.RejectCity: 1},
+		},
+		{
+			name:   "tsv should be ingested",
+			format: FormatTSV,
+			data: "ip_address\tcountry_code\tcountry\tcity\tlatitude\tlongitude\tmystery_value\n" +
+				"200.106.141.15\tSI\tNepal\t\"DuBuquemouth\tNorth\"\t-84.87503094689836\t7.206435933364332\t7823011346\n" +
+				"160.103.7.140\tCZ\tNicaragua\tNew Neva\tnorth\t-37.62435199624531\t7301823115\n",
+			accepted:    1,
+			discarded:   1,
+			discardedBy: map[model.RejectReason]int{model.RejectLatitude: 1},
+			rejects: "line,reason,ip_address,country_code,country,city,latitude,longitude,mystery_value\n" +
+				"3,bad_latitude,160.103.7.140,CZ,Nicaragua,New Neva,north,-37.62435199624531,7301823115\n",
+		},
+		{
+			name:   "ndjson should be ingested",
+			format: FormatNDJSON,
+			data: `{"ip_address": "200.106.141.15", "country_code": "SI", "Country": "Nepal", "city": "DuBuquemouth", "latitude": -84.87503094689836, "longitude": 7.206435933364332, "mystery_value": 7823011346, "source": "feed-a"}` + "\n" +
+				"\n" +
+				`{"ip_network": "200.106.0.0/16", "country_code": "CZ", "country": "Nicaragua", "city": "New Neva", "latitude": "-68.31023296602508", "longitude": -37.62435199624531, "mystery_value": null}` + "\n" +
+				`{"ip_address": "160.103.7.140", "country_code": "CZ", "country": "Nicaragua", "city": "New Neva",` + "\n" +
+				`{"ip_address": "70.95.73.73", "country_code": "TL", "country": "Saudi Arabia", "latitude": -49.16675918861615, "longitude": -86.05920084416894}`,
+			accepted:    2,
+			discarded:   2,
+			discardedBy: map[model.RejectReason]int{model.RejectMalformed: 1, model.RejectCity: 1},
+			rejects: "line,reason,ip_address,country_code,country,city,latitude,longitude,mystery_value\n" +
+				`4,malformed_row,"{""ip_address"": ""160.103.7.140"", ""country_code"": ""CZ"", ""country"": ""Nicaragua"", ""city"": ""New Neva"","` + "\n" +
+				"5,empty_city,70.95.73.73,TL,Saudi Arabia,,-49.16675918861615,-86.05920084416894,\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := mock.New()
+			assert.Nil(t, err, "NewMockConnection() failed, expected no error, got %v", err)
+			rejects := strings.Builder{}
+			ingestor, err := NewIngestor(tt.format, conn, strings.NewReader(tt.data), IngestOptions{Rejects: &rejects})
+			assert.Nil(t, err, "NewIngestor() failed, expected no error, got %v", err)
+			stat, err := ingestor.Ingest(ctx)
+			assert.Nil(t, err, "Ingest() failed, expected no error, got %v", err)
+			assert.Equal(t, tt.accepted, stat.Accepted, "expected %d accepted locations, got %d", tt.accepted, stat.Accepted)
+			assert.Equal(t, tt.discarded, stat.Discarded, "expected %d discarded locations, got %d", tt.discarded, stat.Discarded)
+			assert.Equal(t, tt.discardedBy, stat.DiscardedBy, "discarded rows must be broken down by reason")
+			if tt.rejects != "" {
+				assert.Equal(t, tt.rejects, rejects.String(), "rejects must list every discarded row")
+			}
+			got, err := conn.Get(ctx, "200.106.141.15")
+			assert.Nil(t, err, "Get() failed, expected no error, got %v", err)
+			assert.Equal(t, "SI", got.CountryCode, "country code must match, wanted %v, got %v", "SI", got.CountryCode)
+		})
+	}
+
+	_, err := NewIngestor("xlsx", nil, strings.NewReader(""), IngestOptions{})
+	assert.NotNil(t, err, "expected unknown format to fail, got nil")
+}
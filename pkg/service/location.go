@@ -20,9 +20,22 @@ func NewLocationService(store internal.Store) *LocationService {
 	return &LocationService{store}
 }
 
-// Resolve handles ip resolution request
+// maxBatchSize caps the number of ip addresses a single batch resolution request may carry,
+// maxBatchBytes caps the size of its body accordingly
+const (
+	maxBatchSize  = 10000
+	maxBatchBytes = maxBatchSize * 64
+)
+
+// Resolve handles ip resolution request,
+// a GET resolves the 'ip' query param & a POST resolves a JSON array of ip addresses (see ResolveMany)
 func (l *LocationService) Resolve(w http.ResponseWriter, r *http.Request) {
-	// onyl GET & OPTION method are allowed
+	if r.Method == http.MethodPost {
+		l.ResolveMany(w, r)
+		return
+	}
+
+	// onyl GET, POST & OPTION method are allowed
 	if r.Method != http.MethodGet && r.Method != http.MethodOptions {
 		w.Header().Set("Content-Type", "text/html")
 		w.WriteHeader(http.StatusMethodNotAllowed)
@@ -32,14 +45,16 @@ func (l *LocationService) Resolve(w http.ResponseWriter, r *http.Request) {
 	// read ip address from query params
 	ip := r.URL.Query().Get("ip")
 
-	// validate ip
-	if ok, _ := utils.IsIPValid(ip); !ok {
+	// validate ip (IPv4 or IPv6) & bring it to its canonical form
+	ok, canonical := utils.IsIPValid(ip)
+	if !ok {
 		w.Header().Set("Content-Type", "text/html")
 		w.WriteHeader(http.StatusBadRequest)
 		utils.GetLogger().WithFields(logrus.Fields{"ip": ip}).Error(utils.ErrBadRequest.Error())
 		w.Write([]byte(utils.ErrBadRequest.Error()))
 		return
 	}
+	ip = canonical
 
 	// initialise a common logger
 	logger := utils.GetLogger().WithFields(logrus.Fields{"ip": ip})
@@ -63,6 +78,7 @@ func (l *LocationService) Resolve(w http.ResponseWriter, r *http.Request) {
 	logger.WithFields(logrus.Fields{"row": row}).Debug("ip address resolved")
 	bytes, err := json.MarshalIndent(model.Location{
 		IPAddress:    ip,
+		Network:      row.Network,
 		CountryCode:  row.CountryCode,
 		Country:      row.Country,
 		City:         row.City,
@@ -80,3 +96,78 @@ func (l *LocationService) Resolve(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	w.Write(bytes)
 }
+
+// ResolveMany handles batch ip resolution request, the body must be a JSON array of ip addresses.
+// Responds with one model.Resolution per requested ip address in request order,
+// invalid & unknown addresses are marked with their own status instead of failing the whole batch
+func (l *LocationService) ResolveMany(w http.ResponseWriter, r *http.Request) {
+	logger := utils.GetLogger().WithFields(logrus.Fields{"batch": true})
+
+	// read ip addresses from the body
+	ips := []string{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBatchBytes)).Decode(&ips); err != nil || len(ips) == 0 {
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusBadRequest)
+		logger.WithFields(logrus.Fields{"err": err}).Error(utils.ErrBadBatchRequest.Error())
+		w.Write([]byte(utils.ErrBadBatchRequest.Error()))
+		return
+	}
+	if len(ips) > maxBatchSize {
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		logger.WithFields(logrus.Fields{"count": len(ips)}).Error(utils.ErrBatchTooLarge.Error())
+		w.Write([]byte(utils.ErrBatchTooLarge.Error()))
+		return
+	}
+
+	// validate & canonicalise every ip, only valid ones are looked up
+	resolutions := make([]model.Resolution, len(ips))
+	valid := make([]string, 0, len(ips))
+	for i, ip := range ips {
+		resolutions[i].IP = ip
+		ok, canonical := utils.IsIPValid(ip)
+		if !ok {
+			resolutions[i].Status = http.StatusBadRequest
+			resolutions[i].Error = utils.ErrBadRequest.Error()
+			continue
+		}
+		valid = append(valid, canonical)
+	}
+
+	// resolve all valid ips in one go or fail fast
+	locations, err := l.store.GetMany(r.Context(), valid)
+	if err != nil {
+		logger.WithFields(logrus.Fields{"err": err}).Error("resolving ip addresses failed")
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(utils.ErrInternalServerError.Error()))
+		return
+	}
+
+	// prepare response
+	for i := range resolutions {
+		if resolutions[i].Status != 0 {
+			continue
+		}
+		_, canonical := utils.IsIPValid(resolutions[i].IP)
+		location, ok := locations[canonical]
+		if !ok {
+			resolutions[i].Status = http.StatusNotFound
+			resolutions[i].Error = utils.ErrNotFound.Error()
+			continue
+		}
+		resolutions[i].Status = http.StatusOK
+		resolutions[i].Location = location
+	}
+	logger.WithFields(logrus.Fields{"count": len(ips), "resolved": len(locations)}).Debug("ip addresses resolved")
+	bytes, err := json.MarshalIndent(resolutions, "", " ")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		logger.WithFields(logrus.Fields{"err": err}).Error("MarshalIndent() failed")
+		w.Write([]byte(utils.ErrInternalServerError.Error()))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(bytes)
+}
@@ -2,12 +2,14 @@ package service
 
 import (
 	"context"
+	"encoding/json"
 	"geolocation/internal"
 	"geolocation/internal/model"
 	"geolocation/internal/store/mock"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
 	"time"
 
@@ -77,6 +79,42 @@ func TestLocationService_Resolve(t *testing.T) {
 			ctx:    ctx,
 			ctxErr: false,
 		},
+		{
+			name:   "ipv4 mapped ipv6 notation, should be resolved to the ipv4 row with status of 200 OK",
+			fields: fields{conn},
+			ip:     "::ffff:192.168.0.0",
+			status: http.StatusOK,
+			seed: &model.Location{
+				IPAddress:    "192.168.0.0",
+				CountryCode:  "IN",
+				Country:      "India",
+				City:         "Bengaluru",
+				Latitude:     19.3445466755,
+				Longitude:    45.9454878475,
+				MysteryValue: "anything",
+			},
+			method: http.MethodGet,
+			ctx:    ctx,
+			ctxErr: false,
+		},
+		{
+			name:   "valid ipv6, should be resolved with status of 200 OK",
+			fields: fields{conn},
+			ip:     "2001:0db8:0000:0000:0000:0000:0000:0068",
+			status: http.StatusOK,
+			seed: &model.Location{
+				IPAddress:    "2001:db8::68",
+				CountryCode:  "NL",
+				Country:      "Netherlands",
+				City:         "Amsterdam",
+				Latitude:     52.3675734,
+				Longitude:    4.9041389,
+				MysteryValue: "anything",
+			},
+			method: http.MethodGet,
+			ctx:    ctx,
+			ctxErr: false,
+		},
 		{
 			name:   "missing ip, should be resolved with status of 400 Bad Request",
 			fields: fields{conn},
@@ -126,12 +164,12 @@ func TestLocationService_Resolve(t *testing.T) {
 			ctxErr: true,
 		},
 		{
-			name:   "except GET or OPTION requests no other requests are allowed, should be resolved with status of 405 Method Not Allowed",
+			name:   "except GET, POST or OPTION requests no other requests are allowed, should be resolved with status of 405 Method Not Allowed",
 			fields: fields{conn},
 			ip:     "125.159.20.54",
 			status: http.StatusMethodNotAllowed,
 			seed:   nil,
-			method: http.MethodPost,
+			method: http.MethodPut,
 			ctx:    ctx,
 			ctxErr: false,
 		},
@@ -144,7 +182,7 @@ func TestLocationService_Resolve(t *testing.T) {
 			assert.Nil(t, err, "NewRequest() failed, expected no error, got %v", err)
 			l := &LocationService{tt.fields.store}
 			if tt.seed != nil {
-				err = l.store.BulkCreate(r.Context(), []model.Location{*tt.seed})
+				_, err = l.store.BulkCreate(r.Context(), []model.Location{*tt.seed}, model.WriteOptions{})
 				if tt.ctxErr {
 					assert.Equal(t, context.DeadlineExceeded, err, "BulkCreate() expecting error %v, got %v", context.DeadlineExceeded, err)
 				} else {
@@ -156,3 +194,69 @@ func TestLocationService_Resolve(t *testing.T) {
 		})
 	}
 }
+
+func TestLocationService_ResolveMany(t *testing.T) {
+	conn, err := mock.New()
+	assert.Nil(t, err, "NewMockConnection() failed, expected no error, got %v", err)
+	_, err = conn.BulkCreate(context.Background(), []model.Location{
+		{IPAddress: "192.168.0.0", CountryCode: "IN", Country: "India", City: "Bengaluru", Latitude: 19.3445466755, Longitude: 45.9454878475, MysteryValue: "anything"},
+		{IPAddress: "2001:db8::/32", Network: "2001:db8::/32", CountryCode: "NL", Country: "Netherlands", City: "Amsterdam", Latitude: 52.3675734, Longitude: 4.9041389},
+	}, model.WriteOptions{})
+	assert.Nil(t, err, "BulkCreate() failed, expected no error, got %v", err)
+	l := NewLocationService(conn)
+
+	tests := []struct {
+		name     string
+		body     string
+		status   int
+		statuses []int
+		cities   []string
+	}{
+		{
+			name:     "mixed batch should be resolved per ip with status of 200 OK",
+			body:     `["192.168.0.0", "::ffff:192.168.0.0", "2001:db8::1", "125.159.20.54", "192.168.abc.cba"]`,
+			status:   http.StatusOK,
+			statuses: []int{http.StatusOK, http.StatusOK, http.StatusOK, http.StatusNotFound, http.StatusBadRequest},
+			cities:   []string{"Bengaluru", "Bengaluru", "Amsterdam", "", ""},
+		},
+		{
+			name:   "empty batch should be resolved with status of 400 Bad Request",
+			body:   `[]`,
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "malformed body should be resolved with status of 400 Bad Request",
+			body:   `{"ip": "192.168.0.0"}`,
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "oversized batch should be resolved with status of 413 Request Entity Too Large",
+			body:   `[` + strings.Repeat(`"1.1.1.1",`, maxBatchSize) + `"1.1.1.1"]`,
+			status: http.StatusRequestEntityTooLarge,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r, err := http.NewRequest(http.MethodPost, "/resolve", strings.NewReader(tt.body))
+			assert.Nil(t, err, "NewRequest() failed, expected no error, got %v", err)
+			l.Resolve(w, r)
+			assert.Equal(t, tt.status, w.Code, "expectd status %d, got %d", tt.status, w.Code)
+			if tt.status != http.StatusOK {
+				return
+			}
+			resolutions := []model.Resolution{}
+			err = json.Unmarshal(w.Body.Bytes(), &resolutions)
+			assert.Nil(t, err, "Unmarshal() failed, expected no error, got %v", err)
+			assert.Equal(t, len(tt.statuses), len(resolutions), "expected %d resolutions, got %d", len(tt.statuses), len(resolutions))
+			for i, resolution := range resolutions {
+				assert.Equal(t, tt.statuses[i], resolution.Status, "expected status %d for %s, got %d", tt.statuses[i], resolution.IP, resolution.Status)
+				if tt.cities[i] != "" {
+					assert.Equal(t, tt.cities[i], resolution.Location.City, "expected city %s for %s, got %s", tt.cities[i], resolution.IP, resolution.Location.City)
+				} else {
+					assert.Nil(t, resolution.Location, "expected no location for %s, got %#v", resolution.IP, resolution.Location)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package service
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ManifestEntry is a file listed by a manifest along with its expected checksum (if any)
+type ManifestEntry struct {
+	Path     string
+	Checksum string
+}
+
+// ReadManifest reads a manifest listing the files of a dump, one per line, in the format of sha256sum & alike:
+// "<checksum>  <file>" (md5, sha1, sha256 or sha512, told by its length) or just "<file>" to skip verification.
+// Relative paths are resolved against the directory of the manifest, blank lines & lines starting with # are ignored
+func ReadManifest(manifest string) ([]ManifestEntry, error) {
+	f, err := os.Open(manifest)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	dir := filepath.Dir(manifest)
+	entries := []ManifestEntry{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		entry := ManifestEntry{}
+		if fields := strings.Fields(text); len(fields) == 1 {
+			entry.Path = fields[0]
+		} else {
+			// a leading '*' marks files checksummed in binary mode
+			entry.Checksum = strings.ToLower(fields[0])
+			entry.Path = strings.TrimPrefix(strings.TrimSpace(strings.TrimPrefix(text, fields[0])), "*")
+			if _, err := newChecksum(entry.Checksum); err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", manifest, line, err)
+			}
+		}
+		if !filepath.IsAbs(entry.Path) {
+			entry.Path = filepath.Join(dir, entry.Path)
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("manifest %s lists no file", manifest)
+	}
+	return entries, nil
+}
+
+// Verify makes sure a file matches its checksum from the manifest, entries without checksum always do
+func (e ManifestEntry) Verify() error {
+	if e.Checksum == "" {
+		return nil
+	}
+	h, err := newChecksum(e.Checksum)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(e.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != e.Checksum {
+		return fmt.Errorf("checksum mismatch of %s, expected %s, got %s", e.Path, e.Checksum, got)
+	}
+	return nil
+}
+
+// newChecksum returns the hash of a hex encoded checksum, told by its length
+func newChecksum(checksum string) (hash.Hash, error) {
+	if _, err := hex.DecodeString(checksum); err == nil {
+		switch len(checksum) {
+		case 2 * md5.Size:
+			return md5.New(), nil
+		case 2 * sha1.Size:
+			return sha1.New(), nil
+		case 2 * sha256.Size:
+			return sha256.New(), nil
+		case 2 * sha512.Size:
+			return sha512.New(), nil
+		}
+	}
+	return nil, fmt.Errorf("invalid checksum %q, only md5, sha1, sha256 & sha512 are supported", checksum)
+}
+
+// Expand lists the files a directory or a glob pattern (e.g. shards/*.csv.gz) stands for, in lexical order.
+// Every file of a directory whose name tells a known format (see FormatOf), possibly compressed (see Unpack), is listed.
+// Anything else (e.g. Stdin or a URL) is returned as is
+func Expand(pattern string) ([]string, error) {
+	if pattern == Stdin || strings.Contains(pattern, "://") {
+		return []string{pattern}, nil
+	}
+	if info, err := os.Stat(pattern); err == nil && info.IsDir() {
+		entries, err := os.ReadDir(pattern)
+		if err != nil {
+			return nil, err
+		}
+		files := []string{}
+		for _, entry := range entries {
+			if !entry.IsDir() && dumpFile(entry.Name()) {
+				files = append(files, filepath.Join(pattern, entry.Name()))
+			}
+		}
+		if len(files) == 0 {
+			return nil, fmt.Errorf("directory %s holds no csv, tsv or ndjson file", pattern)
+		}
+		return files, nil
+	}
+	if !strings.ContainsAny(pattern, "*?[") {
+		return []string{pattern}, nil
+	}
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no file matches %s", pattern)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// dumpFile tells whether a file name looks like a dump, possibly compressed
+func dumpFile(name string) bool {
+	if strings.EqualFold(filepath.Ext(name), ".zip") {
+		return true
+	}
+	_, err := FormatOf(trimExt(name, ".gz", ".gzip", ".zst", ".zstd"))
+	return err == nil
+}
@@ -0,0 +1,102 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadManifest(t *testing.T) {
+	dir := t.TempDir()
+	shard := csv_header + "\n200.106.141.15,SI,Nepal,DuBuquemouth,-84.87503094689836,7.206435933364332,7823011346\n"
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "shard-1.csv"), []byte(shard), 0600), "WriteFile() failed")
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "shard-2.csv"), []byte(shard), 0600), "WriteFile() failed")
+	tests := []struct {
+		name     string
+		manifest string
+		paths    []string
+		wantErr  bool
+		badFiles []string
+	}{
+		{
+			name: "checksums should be read",
+			manifest: "# shards of the dump\n" +
+				"15ED3E2B39C121ACAB2B10EC9E357D328D367FFFBF4F29BC78EA5F1F455CC418  shard-1.csv\n" +
+				"\n" +
+				"d41d8cd98f00b204e9800998ecf8427e *shard-2.csv\n",
+			paths:    []string{filepath.Join(dir, "shard-1.csv"), filepath.Join(dir, "shard-2.csv")},
+			badFiles: []string{filepath.Join(dir, "shard-2.csv")},
+		},
+		{
+			name:     "files without checksum should be read",
+			manifest: "shard-1.csv\n" + filepath.Join(dir, "shard-2.csv") + "\n",
+			paths:    []string{filepath.Join(dir, "shard-1.csv"), filepath.Join(dir, "shard-2.csv")},
+		},
+		{name: "unknown checksums should fail", manifest: "abc  shard-1.csv\n", wantErr: true},
+		{name: "empty manifest should fail", manifest: "# nothing\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manifest := filepath.Join(dir, "MANIFEST")
+			assert.Nil(t, os.WriteFile(manifest, []byte(tt.manifest), 0600), "WriteFile() failed")
+			entries, err := ReadManifest(manifest)
+			if tt.wantErr {
+				assert.NotNil(t, err, "expected ReadManifest() to fail, got %v", entries)
+				return
+			}
+			assert.Nil(t, err, "ReadManifest() failed, expected no error, got %v", err)
+			paths := []string{}
+			for _, entry := range entries {
+				paths = append(paths, entry.Path)
+				bad := false
+				for _, f := range tt.badFiles {
+					bad = bad || f == entry.Path
+				}
+				if bad {
+					assert.NotNil(t, entry.Verify(), "expected Verify(%s) to fail on a checksum mismatch", entry.Path)
+				} else {
+					assert.Nil(t, entry.Verify(), "Verify(%s) failed, expected no error", entry.Path)
+				}
+			}
+			assert.Equal(t, tt.paths, paths, "paths must be resolved against the manifest")
+		})
+	}
+
+	entry := ManifestEntry{Path: filepath.Join(dir, "shard-1.csv"), Checksum: "8d0dba4a1d5fb6ffa4b3e4c2ab76f0b3e43c1b6e"}
+	assert.NotNil(t, entry.Verify(), "expected a sha1 mismatch to fail")
+}
+
+func TestExpand(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"b.csv.gz", "a.csv", "c.ndjson", "d.zip", "notes.txt"} {
+		assert.Nil(t, os.WriteFile(filepath.Join(dir, name), nil, 0600), "WriteFile() failed")
+	}
+	assert.Nil(t, os.Mkdir(filepath.Join(dir, "e.csv"), 0700), "Mkdir() failed")
+	tests := []struct {
+		name    string
+		pattern string
+		files   []string
+		wantErr bool
+	}{
+		{name: "directory should list dumps", pattern: dir, files: []string{filepath.Join(dir, "a.csv"), filepath.Join(dir, "b.csv.gz"), filepath.Join(dir, "c.ndjson"), filepath.Join(dir, "d.zip")}},
+		{name: "glob should list matches", pattern: filepath.Join(dir, "*.csv*"), files: []string{filepath.Join(dir, "a.csv"), filepath.Join(dir, "b.csv.gz"), filepath.Join(dir, "e.csv")}},
+		{name: "file should be kept", pattern: filepath.Join(dir, "a.csv"), files: []string{filepath.Join(dir, "a.csv")}},
+		{name: "URL should be kept", pattern: "https://example.com/dump.csv?v=1", files: []string{"https://example.com/dump.csv?v=1"}},
+		{name: "stdin should be kept", pattern: Stdin, files: []string{Stdin}},
+		{name: "unmatched glob should fail", pattern: filepath.Join(dir, "*.tsv"), wantErr: true},
+		{name: "directory without dumps should fail", pattern: filepath.Join(dir, "e.csv"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files, err := Expand(tt.pattern)
+			if tt.wantErr {
+				assert.NotNil(t, err, "expected Expand() to fail, got %v", files)
+				return
+			}
+			assert.Nil(t, err, "Expand() failed, expected no error, got %v", err)
+			assert.Equal(t, tt.files, files, "files must match, wanted %v, got %v", tt.files, files)
+		})
+	}
+}
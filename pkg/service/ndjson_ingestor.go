@@ -0,0 +1,110 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"geolocation/internal"
+	"geolocation/internal/model"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// NDJSONIngestor is intended to read valid geolocation data from a newline delimited json file,
+// one object per line whose keys name the columns, and ingest it in database
+type NDJSONIngestor struct {
+	store internal.Store
+	r     io.Reader
+	opts  IngestOptions
+}
+
+// NewNDJSONIngestor creates new instance of NDJSONIngestor
+func NewNDJSONIngestor(store internal.Store, r io.Reader, opts IngestOptions) *NDJSONIngestor {
+	return &NDJSONIngestor{store, r, opts}
+}
+
+// Ingest streams the ndjson file, just like CSVIngestor.Ingest does with a csv file
+func (c *NDJSONIngestor) Ingest(ctx context.Context) (*model.Stat, error) {
+	return ingest(ctx, c.store, single(c.r, ndjsonFormat{}), c.opts)
+}
+
+// ndjsonFormat reads newline delimited json objects, turning their values into rows in the order of csv_header
+type ndjsonFormat struct{}
+
+// open finds the columns by the keys of every object, so there's no header to read
+func (f ndjsonFormat) open(r io.Reader, cfg model.Columns, from mark) (func() (row, error), []string, *layout, error) {
+	names, err := columnNames(cfg)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	header := strings.Split(csv_header, ",")
+	l := &layout{width: len(header)}
+	for c := range l.index {
+		l.index[c] = c
+	}
+
+	line, offset := 0, int64(0)
+	start, err := inputStart(r, from)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	resumed, err := resumeAfter(r, start, from, true)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if resumed {
+		line, offset = from.line, from.offset
+	}
+	rdr := bufio.NewReader(r)
+	read := func() (row, error) {
+		for {
+			raw, err := rdr.ReadBytes('\n')
+			if err != nil && (err != io.EOF || len(raw) == 0) {
+				return row{}, err
+			}
+			line++
+			offset += int64(len(raw))
+			raw = bytes.TrimSpace(raw)
+			if len(raw) == 0 {
+				continue
+			}
+			values, ok := objectValues(raw, names)
+			if !ok {
+				return row{line: line, offset: offset, values: []string{string(raw)}, reason: model.RejectMalformed}, nil
+			}
+			return row{line: line, offset: offset, values: values}, nil
+		}
+	}
+	return read, header, l, nil
+}
+
+// objectValues turns a json object into the values of a row, keys unknown to names are ignored
+func objectValues(raw []byte, names map[string]column) ([]string, bool) {
+	object := map[string]interface{}{}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	if err := decoder.Decode(&object); err != nil || decoder.More() {
+		return nil, false
+	}
+	values := make([]string, columns)
+	for key, value := range object {
+		c, ok := names[normalise(key)]
+		if !ok {
+			continue
+		}
+		switch v := value.(type) {
+		case nil:
+		case string:
+			values[c] = v
+		case json.Number:
+			values[c] = v.String()
+		case bool:
+			values[c] = strconv.FormatBool(v)
+		default:
+			return nil, false
+		}
+	}
+	return values, true
+}
@@ -0,0 +1,444 @@
+package service
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"geolocation/internal"
+	"geolocation/internal/model"
+	"geolocation/internal/utils"
+	"hash/fnv"
+	"io"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// readChunkSize is the number of records handed over to a validation worker at once
+const readChunkSize = 1000
+
+// row is the values of a row along with its line number in the file & the byte offset right after it,
+// a row which couldn't be parsed comes with the reason to discard it & its raw values
+type row struct {
+	line   int
+	offset int64
+	values []string
+	reason model.RejectReason
+}
+
+// mark is a position within a file, right after the row at line (see model.Checkpoint)
+type mark struct {
+	line   int
+	offset int64
+}
+
+// chunk is a run of consecutive rows, numbered by its position in the file
+type chunk struct {
+	seq  int
+	rows []row
+}
+
+// result is a row once sanitised, either a location or the reason it got discarded for
+type result struct {
+	row
+	location *model.Location
+	reason   model.RejectReason
+}
+
+// validated is a chunk once sanitised
+type validated struct {
+	seq     int
+	results []result
+}
+
+// handoff is the share of a writer in a validated chunk, the mark right after every location & after the chunk,
+// along with the locations of a synced dump to mark present
+type handoff struct {
+	locations []model.Location
+	marks     []mark
+	present   []model.Location
+	at        mark
+}
+
+// pipeline ingests rows concurrently through 3 stages: a reader, validation workers sanitising chunks of rows
+// and writer workers flushing batches to the store.
+// Validated chunks are put back in file order, where duplicates & rejects get settled, and every location is handed
+// to the writer owning its ip address, so stats & conflict resolution come out the same whatever the concurrency.
+type pipeline struct {
+	store internal.Store
+	write model.WriteOptions
+	// input is the index of the ingested input, named by name (when ingesting more than one) in rejects
+	input      int
+	name       string
+	layout     *layout
+	duplicates *duplicates
+	rejects    *csv.Writer
+	// scan only records valid rows in duplicates, nothing gets written or accounted for
+	scan bool
+	// dryRun settles & accounts for every row as usual, yet nothing gets written
+	dryRun bool
+	// sync marks every location present in the dump, accepted or discarded as long as its ip address parses,
+	// so that only the ones it no longer holds get deleted
+	sync bool
+	// progress, when set, accounts for every row settled
+	progress *progress
+	// checkpoint, when set, gets the mark every row up to has been written, starting from from
+	checkpoint  func(mark) error
+	from        mark
+	validators  int
+	writers     int
+	batchSize   int
+	memoryLimit int
+}
+
+// newPipeline creates a pipeline writing with the given options, the memory limit gets shared among writers,
+// duplicates get settled by dups and discarded rows get written to rejects (if any)
+func newPipeline(store internal.Store, opts IngestOptions, write model.WriteOptions, dups *duplicates, rejects *csv.Writer) *pipeline {
+	p := &pipeline{store: store, write: write, duplicates: dups, rejects: rejects, validators: opts.Validators, writers: opts.Writers, batchSize: opts.BatchSize}
+	if p.validators <= 0 {
+		p.validators = runtime.NumCPU()
+	}
+	if p.writers <= 0 {
+		p.writers = 1
+	}
+	if opts.MemoryLimit > 0 {
+		p.memoryLimit = opts.MemoryLimit / p.writers
+		if p.memoryLimit == 0 {
+			p.memoryLimit = 1
+		}
+	}
+	return p
+}
+
+// run feeds every row returned by read (till io.EOF) through the pipeline & accounts for them in s,
+// the first failure of any stage (or ctx getting done) stops every stage
+func (p *pipeline) run(ctx context.Context, read func() (row, error), s *model.Stat) error {
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var once sync.Once
+	var failure error
+	fail := func(err error) {
+		once.Do(func() {
+			failure = err
+			cancel()
+		})
+	}
+
+	// read rows in chunks
+	chunks := make(chan chunk, p.validators)
+	var reading sync.WaitGroup
+	reading.Add(1)
+	go func() {
+		defer reading.Done()
+		defer close(chunks)
+		c := chunk{}
+		for {
+			if ctx.Err() != nil {
+				return
+			}
+			r, err := read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				fail(err)
+				return
+			}
+			c.rows = append(c.rows, r)
+			if len(c.rows) == readChunkSize {
+				select {
+				case chunks <- c:
+				case <-ctx.Done():
+					return
+				}
+				c = chunk{seq: c.seq + 1}
+			}
+		}
+		if len(c.rows) > 0 {
+			select {
+			case chunks <- c:
+			case <-ctx.Done():
+			}
+		}
+	}()
+
+	// sanitise chunks
+	results := make(chan validated, p.validators)
+	var validating sync.WaitGroup
+	for i := 0; i < p.validators; i++ {
+		validating.Add(1)
+		go func() {
+			defer validating.Done()
+			for c := range chunks {
+				v := validated{seq: c.seq, results: make([]result, 0, len(c.rows))}
+				for _, r := range c.rows {
+					if r.reason != "" {
+						v.results = append(v.results, result{r, nil, r.reason})
+						continue
+					}
+					location, reason := sanitise(r.values, p.layout)
+					v.results = append(v.results, result{r, location, reason})
+				}
+				select {
+				case results <- v:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		validating.Wait()
+		close(results)
+	}()
+
+	// write shards of locations batch by batch, writers keep draining their shard after a failure
+	shards := make([]chan handoff, p.writers)
+	stats := make([]model.Stat, p.writers)
+	commit := p.committer()
+	var writing sync.WaitGroup
+	for i := range shards {
+		shards[i] = make(chan handoff, 1)
+		writing.Add(1)
+		go func(i int, in <-chan handoff, s *model.Stat) {
+			defer writing.Done()
+			b := newBatch(p.batchSize, p.memoryLimit)
+			// committed is the mark every location handed to this writer up to has been written
+			committed := p.from
+			flush := func() error {
+				if len(b.locations) == 0 && len(b.present) == 0 {
+					return nil
+				}
+				writeStart := time.Now()
+				if len(b.present) > 0 {
+					if err := p.store.MarkPresent(ctx, b.present, p.write); err != nil {
+						return fmt.Errorf("MarkPresent() failed, err: %w", err)
+					}
+				}
+				if len(b.locations) > 0 {
+					written, err := p.store.BulkCreate(ctx, b.locations, p.write)
+					if err != nil {
+						return fmt.Errorf("BulkCreate() failed, err: %w", err)
+					}
+					s.WriteStat.Add(written)
+					s.Batches++
+				}
+				s.WriteTime += time.Since(writeStart)
+				b.reset()
+				return commit(i, committed)
+			}
+			for h := range in {
+				// marked upfront, so they get flushed along with any location of the chunk
+				b.mark(h.present)
+				for j, l := range h.locations {
+					if ctx.Err() != nil {
+						break
+					}
+					if b.add(l) {
+						committed = h.marks[j]
+						if err := flush(); err != nil {
+							fail(err)
+						}
+					}
+				}
+				committed = h.at
+				if len(b.present) >= b.size && ctx.Err() == nil {
+					if err := flush(); err != nil {
+						fail(err)
+					}
+				}
+				// nothing left to write, so the whole chunk is
+				if len(b.locations) == 0 && len(b.present) == 0 && ctx.Err() == nil {
+					if err := commit(i, committed); err != nil {
+						fail(err)
+					}
+				}
+			}
+			if ctx.Err() == nil {
+				if err := flush(); err != nil {
+					fail(err)
+				}
+			}
+		}(i, shards[i], &stats[i])
+	}
+
+	// put validated chunks back in file order, settle duplicates & rejects, then hand locations over to writers
+	pending := map[int]validated{}
+	next := 0
+	for v := range results {
+		if ctx.Err() != nil {
+			continue
+		}
+		pending[v.seq] = v
+		for v, ok := pending[next]; ok; v, ok = pending[next] {
+			delete(pending, next)
+			next++
+			var at mark
+			if len(v.results) > 0 {
+				last := v.results[len(v.results)-1]
+				at = mark{last.line, last.offset}
+			}
+			if p.scan {
+				for _, r := range v.results {
+					if r.location != nil {
+						if err := p.duplicates.scan(position{p.input, r.line}, *r.location); err != nil {
+							fail(err)
+							break
+						}
+					}
+				}
+				p.progress.advance(len(v.results), 0, 0, at.offset)
+				continue
+			}
+			accepted, discarded := s.Accepted, s.Discarded
+			h := handoff{locations: make([]model.Location, 0, len(v.results)), marks: make([]mark, 0, len(v.results))}
+			for _, r := range v.results {
+				if r.location != nil {
+					if r.reason = p.duplicates.settle(position{p.input, r.line}, *r.location); r.reason == "" {
+						h.locations = append(h.locations, *r.location)
+						h.marks = append(h.marks, mark{r.line, r.offset})
+						p.markPresent(&h, r)
+						s.Accepted++
+						continue
+					}
+				}
+				// a discarded row still tells its location is in the dump
+				p.markPresent(&h, r)
+				discard(s, r.reason)
+				if err := p.reject(r); err != nil {
+					fail(err)
+					break
+				}
+			}
+			p.progress.advance(len(v.results), s.Accepted-accepted, s.Discarded-discarded, at.offset)
+			if p.dryRun {
+				continue
+			}
+			h.at = at
+			for i, h := range p.shard(h) {
+				// writers only need empty handoffs to tell how far they got
+				if len(h.locations) > 0 || len(h.present) > 0 || p.checkpoint != nil {
+					shards[i] <- h
+				}
+			}
+		}
+	}
+	for _, in := range shards {
+		close(in)
+	}
+	writing.Wait()
+	reading.Wait()
+
+	// the rows rejected so far matter all the more when the run failed
+	if p.rejects != nil {
+		p.rejects.Flush()
+		if err := p.rejects.Error(); err != nil {
+			if failure != nil {
+				return fmt.Errorf("%w, rejects Flush() failed too, err: %v", failure, err)
+			}
+			return fmt.Errorf("rejects Flush() failed, err: %w", err)
+		}
+	}
+	if failure != nil {
+		return failure
+	}
+	if err := parent.Err(); err != nil {
+		return err
+	}
+	// writers ran concurrently, so their write time adds up
+	for _, stat := range stats {
+		s.WriteStat.Add(stat.WriteStat)
+		s.WriteTime += stat.WriteTime
+		s.Batches += stat.Batches
+	}
+	return nil
+}
+
+// committer returns a func taking the mark a writer got written up to & checkpointing the mark every writer got to,
+// which only moves forward. Writers are called concurrently
+func (p *pipeline) committer() func(writer int, at mark) error {
+	if p.checkpoint == nil {
+		return func(int, mark) error { return nil }
+	}
+	var mu sync.Mutex
+	committed := make([]mark, p.writers)
+	for i := range committed {
+		committed[i] = p.from
+	}
+	checkpointed := p.from
+	return func(writer int, at mark) error {
+		mu.Lock()
+		defer mu.Unlock()
+		committed[writer] = at
+		least := committed[0]
+		for _, m := range committed[1:] {
+			if m.line < least.line {
+				least = m
+			}
+		}
+		if least.line <= checkpointed.line {
+			return nil
+		}
+		checkpointed = least
+		return p.checkpoint(least)
+	}
+}
+
+// reject writes a discarded row along with its line number & the reason it got discarded for
+func (p *pipeline) reject(r result) error {
+	if p.rejects == nil {
+		return nil
+	}
+	record := []string{strconv.Itoa(r.line), string(r.reason)}
+	if p.name != "" {
+		record = append([]string{p.name}, record...)
+	}
+	if err := p.rejects.Write(append(record, r.values...)); err != nil {
+		return fmt.Errorf("rejects Write() failed, err: %w", err)
+	}
+	return nil
+}
+
+// markPresent adds the ip address & network of a settled row to the locations of a synced dump to mark present,
+// discarded rows included as long as their ip address parses
+func (p *pipeline) markPresent(h *handoff, r result) {
+	if !p.sync {
+		return
+	}
+	if r.location != nil {
+		h.present = append(h.present, model.Location{IPAddress: r.location.IPAddress, Network: r.location.Network})
+	} else if l, ok := addressOf(r.values, p.layout); ok {
+		h.present = append(h.present, l)
+	}
+}
+
+// shard splits the locations of a handoff among writers by network, so a host & its /32 always go to the same writer,
+// keeping their order
+func (p *pipeline) shard(h handoff) []handoff {
+	if p.writers == 1 {
+		return []handoff{h}
+	}
+	shards := make([]handoff, p.writers)
+	for j, l := range h.locations {
+		i := p.writer(l)
+		shards[i].locations = append(shards[i].locations, l)
+		shards[i].marks = append(shards[i].marks, h.marks[j])
+	}
+	for _, l := range h.present {
+		i := p.writer(l)
+		shards[i].present = append(shards[i].present, l)
+	}
+	for i := range shards {
+		shards[i].at = h.at
+	}
+	return shards
+}
+
+// writer returns the writer owning the network of a location
+func (p *pipeline) writer(l model.Location) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(utils.NetworkOf(l)))
+	return int(hash.Sum32() % uint32(p.writers))
+}
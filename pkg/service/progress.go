@@ -0,0 +1,123 @@
+package service
+
+import (
+	"geolocation/internal/model"
+	"io"
+	"time"
+)
+
+// DefaultProgressInterval is the least time between 2 progress reports, unless configured otherwise
+const DefaultProgressInterval = time.Second
+
+// SendProgress returns a progress callback (see IngestOptions.Progress) sending every report to ch,
+// reports are dropped rather than slowing the ingestion down while ch is full, the last one excepted
+func SendProgress(ch chan<- model.Progress) func(model.Progress) {
+	return func(p model.Progress) {
+		if p.Done {
+			ch <- p
+			return
+		}
+		select {
+		case ch <- p:
+		default:
+		}
+	}
+}
+
+// progress accounts for the rows read by an ingestion & reports how far it got every interval,
+// it's only ever updated by the goroutine putting validated chunks back in file order.
+// A nil progress reports nothing
+type progress struct {
+	report   func(model.Progress)
+	interval time.Duration
+	started  time.Time
+	reported time.Time
+	// done is the number of bytes of the files (or passes) already read, offset the one of the current file
+	done   int64
+	offset int64
+	// skipped is the number of bytes a resumed ingestion didn't have to read
+	skipped int64
+	model.Progress
+}
+
+// newProgress creates a progress reporting to report every interval (DefaultProgressInterval by default),
+// out of size bytes to consume (0 when unknown), nil without report
+func newProgress(report func(model.Progress), interval time.Duration, size int64) *progress {
+	if report == nil {
+		return nil
+	}
+	if interval <= 0 {
+		interval = DefaultProgressInterval
+	}
+	now := time.Now()
+	return &progress{report: report, interval: interval, started: now, reported: now, Progress: model.Progress{Size: size}}
+}
+
+// next starts reading a file (or reading it again, once scanned) from the given byte offset
+func (p *progress) next(name string, scanning bool, from int64) {
+	if p == nil {
+		return
+	}
+	p.done += p.offset
+	p.offset = from
+	p.skipped += from
+	p.File, p.Scanning = name, scanning
+}
+
+// advance accounts for a chunk of rows read up to the given byte offset of the current file,
+// reporting once the interval elapsed since the last report
+func (p *progress) advance(read, accepted, discarded int, offset int64) {
+	if p == nil {
+		return
+	}
+	p.Read += read
+	p.Accepted += accepted
+	p.Discarded += discarded
+	p.offset = offset
+	if now := time.Now(); now.Sub(p.reported) >= p.interval {
+		p.reported = now
+		p.send(now)
+	}
+}
+
+// finish reports the completed ingestion
+func (p *progress) finish() {
+	if p == nil {
+		return
+	}
+	p.Done = true
+	p.done += p.offset
+	p.offset = 0
+	p.send(time.Now())
+}
+
+// send reports the progress as of now, estimating the time left out of the bytes consumed since started
+func (p *progress) send(now time.Time) {
+	report := p.Progress
+	report.Bytes = p.done + p.offset
+	report.Elapsed = now.Sub(p.started)
+	if seconds := report.Elapsed.Seconds(); seconds > 0 {
+		report.Rate = float64(report.Read) / seconds
+	}
+	if consumed := report.Bytes - p.skipped; report.Size > 0 && consumed > 0 && report.Size > report.Bytes && !report.Done {
+		report.ETA = time.Duration(float64(report.Elapsed) * float64(report.Size-report.Bytes) / float64(consumed))
+	}
+	p.report(report)
+}
+
+// sizeOf returns the number of bytes left to read from r, 0 when unknown (r isn't an io.Seeker)
+func sizeOf(r io.Reader) int64 {
+	rs, ok := r.(io.Seeker)
+	if !ok {
+		return 0
+	}
+	at, err := rs.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0
+	}
+	end, err := rs.Seek(0, io.SeekEnd)
+	if _, seekErr := rs.Seek(at, io.SeekStart); err != nil || seekErr != nil {
+		return 0
+	}
+	return end - at
+}
@@ -0,0 +1,148 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"geolocation/internal"
+	"geolocation/internal/model"
+	"geolocation/internal/utils"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+// Stdin is the location reading a dump from the standard input
+const Stdin = "-"
+
+// ErrNotModified tells a remote dump is unchanged since it got ingested last
+var ErrNotModified = errors.New("dump not modified since last ingested")
+
+// Source is where a dump gets read from
+type Source interface {
+	// Name names the dump, which tells its format (see FormatOf) & compression (see Unpack)
+	Name() string
+	// Open opens the dump, failing with ErrNotModified when it is unchanged since last ingested
+	Open(ctx context.Context) (io.ReadCloser, error)
+	// Ingested records the opened dump as ingested, so that it gets skipped until it changes
+	Ingested(ctx context.Context) error
+}
+
+// NewSource creates the source of a location, which is either
+// Stdin, an http(s):// URL, an s3://bucket/key URL (see model.S3) or a local path.
+// Without store, remote dumps are downloaded every time
+func NewSource(location string, store internal.Store, s3Cfg model.S3) (Source, error) {
+	switch {
+	case location == Stdin:
+		return &fileSource{name: location, open: func() (io.ReadCloser, error) { return io.NopCloser(os.Stdin), nil }}, nil
+	case strings.HasPrefix(location, "http://"), strings.HasPrefix(location, "https://"):
+		u, err := url.Parse(location)
+		if err != nil {
+			return nil, err
+		}
+		return newHTTPSource(location, u, store, nil), nil
+	case strings.HasPrefix(location, "s3://"):
+		u, err := s3URL(location, s3Cfg)
+		if err != nil {
+			return nil, err
+		}
+		return newHTTPSource(location, u, store, func(req *http.Request) error { return signS3(req, s3Cfg) }), nil
+	}
+	return &fileSource{name: location, open: func() (io.ReadCloser, error) {
+		return os.OpenFile(location, os.O_RDONLY, fs.FileMode(os.O_RDONLY))
+	}}, nil
+}
+
+// fileSource reads a local file (or the standard input), which is read every time
+type fileSource struct {
+	name string
+	open func() (io.ReadCloser, error)
+}
+
+func (s *fileSource) Name() string {
+	return s.name
+}
+
+func (s *fileSource) Open(ctx context.Context) (io.ReadCloser, error) {
+	return s.open()
+}
+
+func (s *fileSource) Ingested(ctx context.Context) error {
+	return nil
+}
+
+// httpSource downloads a dump conditionally, sending the validators (ETag & Last-Modified) it got ingested with last
+type httpSource struct {
+	location string
+	url      *url.URL
+	store    internal.Store
+	sign     func(*http.Request) error
+	client   *http.Client
+	// served is the version of the dump opened last
+	served model.Source
+}
+
+func newHTTPSource(location string, u *url.URL, store internal.Store, sign func(*http.Request) error) *httpSource {
+	return &httpSource{location: location, url: u, store: store, sign: sign, client: http.DefaultClient}
+}
+
+// Name is the last element of the URL path
+func (s *httpSource) Name() string {
+	return path.Base(s.url.Path)
+}
+
+func (s *httpSource) Open(ctx context.Context) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	var last *model.Source
+	if s.store != nil {
+		if last, err = s.store.Source(ctx, s.location); err != nil && !errors.Is(err, utils.ErrNotFound) {
+			return nil, fmt.Errorf("Source() failed, err: %w", err)
+		}
+	}
+	if last != nil {
+		if last.ETag != "" {
+			req.Header.Set("If-None-Match", last.ETag)
+		}
+		if last.LastModified != "" {
+			req.Header.Set("If-Modified-Since", last.LastModified)
+		}
+	}
+	if s.sign != nil {
+		if err := s.sign(req); err != nil {
+			return nil, err
+		}
+	}
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case res.StatusCode == http.StatusNotModified:
+		res.Body.Close()
+		return nil, ErrNotModified
+	case res.StatusCode != http.StatusOK:
+		res.Body.Close()
+		return nil, fmt.Errorf("GET %s failed, status: %s", s.location, res.Status)
+	}
+	s.served = model.Source{URL: s.location, ETag: res.Header.Get("ETag"), LastModified: res.Header.Get("Last-Modified")}
+	return res.Body, nil
+}
+
+// Ingested records the validators the dump got served with, a dump served without any is downloaded every time
+func (s *httpSource) Ingested(ctx context.Context) error {
+	if s.store == nil || (s.served.ETag == "" && s.served.LastModified == "") {
+		return nil
+	}
+	if err := s.store.SaveSource(ctx, s.served); err != nil {
+		return fmt.Errorf("SaveSource() failed, err: %w", err)
+	}
+	return nil
+}
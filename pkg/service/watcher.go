@@ -0,0 +1,238 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"geolocation/internal/utils"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultSettle is how long a file must go unchanged before it's deemed complete, unless configured otherwise
+const DefaultSettle = 5 * time.Second
+
+// WatchOptions tune a Watcher, the zero value is a valid default
+type WatchOptions struct {
+	// Archive is the directory ingested dumps are moved to, defaults to the archive directory within the watched one
+	Archive string
+	// Failed is the directory dumps which failed to ingest are moved to, defaults to the failed directory within the watched one
+	Failed string
+	// Settle is how long a file must go unchanged (size & modification time) before it's deemed complete,
+	// defaults to DefaultSettle
+	Settle time.Duration
+}
+
+// Watcher is intended to ingest every dump dropped into a directory, one at a time
+type Watcher struct {
+	dir  string
+	opts WatchOptions
+}
+
+// NewWatcher creates new instance of the Watcher of the given directory
+func NewWatcher(dir string, opts WatchOptions) *Watcher {
+	if opts.Archive == "" {
+		opts.Archive = filepath.Join(dir, "archive")
+	}
+	if opts.Failed == "" {
+		opts.Failed = filepath.Join(dir, "failed")
+	}
+	if opts.Settle <= 0 {
+		opts.Settle = DefaultSettle
+	}
+	return &Watcher{dir, opts}
+}
+
+// pendingFile is a dump of the watched directory, possibly still being written, as last seen
+type pendingFile struct {
+	size    int64
+	modTime time.Time
+	since   time.Time
+}
+
+// Watch hands every complete dump of the directory (see Expand for what looks like a dump) to ingest, one at a time
+// in the order they completed, then moves it to the archive directory, or the failed one when ingest failed.
+// Dumps already in the directory get ingested first. A file is complete once it went unchanged for the settle time,
+// hidden files (.name) are left alone, so a dump can be written under such a name then renamed once complete.
+// Dumps get ingested by a worker while events keep being drained, the directory gets scanned again whenever events
+// overflowed, other errors (of the watcher or archiving a dump) are logged & watching goes on.
+// Watch blocks till ctx is done, which leaves the dump being ingested (if any) in place, or the directory can't be watched
+func (w *Watcher) Watch(ctx context.Context, ingest func(ctx context.Context, path string) error) error {
+	for _, dir := range []string{w.opts.Archive, w.opts.Failed} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return fmt.Errorf("MkdirAll(%s) failed, err: %w", dir, err)
+		}
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("NewWatcher() failed, err: %w", err)
+	}
+	defer watcher.Close()
+	if err := watcher.Add(w.dir); err != nil {
+		return fmt.Errorf("watching %s failed, err: %w", w.dir, err)
+	}
+
+	// pick up the dumps dropped before watching, then the ones every event tells about
+	pending, queued := map[string]*pendingFile{}, map[string]bool{}
+	if err := w.scan(pending, queued); err != nil {
+		return err
+	}
+
+	// complete dumps get queued for the worker, and stay queued till it's done with them, so they aren't tracked again
+	queue := []string{}
+	work, done := make(chan string), make(chan string)
+	quit, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case path := <-work:
+				w.ingest(ctx, path, ingest)
+				select {
+				case done <- path:
+				case <-quit:
+					return
+				}
+			case <-quit:
+				return
+			}
+		}
+	}()
+	defer func() {
+		close(quit)
+		<-stopped
+	}()
+
+	ticker := time.NewTicker(w.opts.Settle / 4)
+	defer ticker.Stop()
+	for {
+		// only offer the next dump once there's one
+		var next chan string
+		if len(queue) > 0 {
+			next = work
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case next <- firstOf(queue):
+			queue = queue[1:]
+		case path := <-done:
+			delete(queued, path)
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return fmt.Errorf("watching %s stopped", w.dir)
+			}
+			if event.Op&(fsnotify.Create|fsnotify.Write|fsnotify.Chmod) != 0 && !queued[event.Name] {
+				w.track(pending, event.Name)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return fmt.Errorf("watching %s stopped", w.dir)
+			}
+			logger := utils.GetLogger().WithFields(logrus.Fields{"dir": w.dir, "err": err})
+			if !errors.Is(err, fsnotify.ErrEventOverflow) {
+				logger.Error("watching failed, some dumps may only be picked up once written to again")
+				continue
+			}
+			// events got lost, the directory tells which dumps there are
+			logger.Warn("watching overflowed, scanning the directory again")
+			if err := w.scan(pending, queued); err != nil {
+				utils.GetLogger().WithFields(logrus.Fields{"dir": w.dir, "err": err}).Error("scan() failed, some dumps may only be picked up once written to again")
+			}
+		case now := <-ticker.C:
+			for _, path := range w.complete(pending, now) {
+				queue = append(queue, path)
+				queued[path] = true
+			}
+		}
+	}
+}
+
+// firstOf returns the first of the queued dumps, if any
+func firstOf(queue []string) string {
+	if len(queue) == 0 {
+		return ""
+	}
+	return queue[0]
+}
+
+// ingest hands a complete dump to ingest then moves it to the archive directory, or the failed one when ingest failed,
+// failing to move it is logged as it can't be helped
+func (w *Watcher) ingest(ctx context.Context, path string, ingest func(ctx context.Context, path string) error) {
+	ingestErr := ingest(ctx, path)
+	if ctx.Err() != nil {
+		return
+	}
+	dst := w.opts.Archive
+	if ingestErr != nil {
+		dst = w.opts.Failed
+	}
+	if err := os.Rename(path, filepath.Join(dst, archivedName(path, time.Now()))); err != nil {
+		utils.GetLogger().WithFields(logrus.Fields{"file": path, "dir": dst, "err": err}).Error("Rename() failed, the dump is left in place")
+	}
+}
+
+// scan tracks every dump of the watched directory, but the queued ones
+func (w *Watcher) scan(pending map[string]*pendingFile, queued map[string]bool) error {
+	entries, err := os.ReadDir(w.dir)
+	if err != nil {
+		return fmt.Errorf("ReadDir(%s) failed, err: %w", w.dir, err)
+	}
+	for _, entry := range entries {
+		if path := filepath.Join(w.dir, entry.Name()); !queued[path] {
+			w.track(pending, path)
+		}
+	}
+	return nil
+}
+
+// track starts (or keeps) tracking a file of the watched directory, provided it looks like a dump
+func (w *Watcher) track(pending map[string]*pendingFile, path string) {
+	name := filepath.Base(path)
+	if strings.HasPrefix(name, ".") || !dumpFile(name) {
+		return
+	}
+	if _, ok := pending[path]; !ok {
+		pending[path] = &pendingFile{since: time.Now()}
+	}
+}
+
+// complete returns the tracked files which went unchanged for the settle time as of now, in the order they completed,
+// & stops tracking them along with the ones which are gone
+func (w *Watcher) complete(pending map[string]*pendingFile, now time.Time) []string {
+	complete := []string{}
+	for path, p := range pending {
+		info, err := os.Stat(path)
+		if err != nil || !info.Mode().IsRegular() {
+			delete(pending, path)
+			continue
+		}
+		if info.Size() != p.size || !info.ModTime().Equal(p.modTime) {
+			p.size, p.modTime, p.since = info.Size(), info.ModTime(), now
+			continue
+		}
+		if now.Sub(p.since) >= w.opts.Settle {
+			complete = append(complete, path)
+		}
+	}
+	sort.Slice(complete, func(i, j int) bool {
+		a, b := pending[complete[i]], pending[complete[j]]
+		return a.since.Before(b.since) || (a.since.Equal(b.since) && complete[i] < complete[j])
+	})
+	for _, path := range complete {
+		delete(pending, path)
+	}
+	return complete
+}
+
+// archivedName prefixes the name of a file with the time it got archived at, so that dumps dropped under the same name
+// never overwrite each other
+func archivedName(path string, at time.Time) string {
+	return at.UTC().Format("20060102T150405.000000000") + "_" + filepath.Base(path)
+}
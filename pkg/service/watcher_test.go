@@ -0,0 +1,125 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWatcher_Watch(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644)
+		assert.Nil(t, err, "WriteFile() failed, expected no error, got %v", err)
+	}
+	// dropped before watching
+	write("first.csv", csv_header+"\n")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	ingested := make(chan string, 10)
+	done := make(chan error, 1)
+	go func() {
+		w := NewWatcher(dir, WatchOptions{Settle: 50 * time.Millisecond})
+		done <- w.Watch(ctx, func(ctx context.Context, path string) error {
+			content, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			ingested <- filepath.Base(path)
+			if strings.Contains(string(content), "bogus") {
+				return errors.New("bogus dump")
+			}
+			return nil
+		})
+	}()
+
+	wait := func() string {
+		select {
+		case name := <-ingested:
+			return name
+		case <-ctx.Done():
+			t.Fatalf("expected a dump to be ingested, got none")
+		}
+		return ""
+	}
+	assert.Equal(t, "first.csv", wait(), "expected the dump dropped before watching to be ingested")
+
+	// hidden & unknown files are left alone, a dump written in parts only gets ingested once complete
+	write(".second.csv", csv_header+"\n")
+	write("notes.txt", "not a dump")
+	f, err := os.Create(filepath.Join(dir, "second.csv.gz"))
+	assert.Nil(t, err, "Create() failed, expected no error, got %v", err)
+	for i := 0; i < 3; i++ {
+		f.WriteString("part\n")
+		time.Sleep(20 * time.Millisecond)
+	}
+	f.Close()
+	assert.Equal(t, "second.csv.gz", wait(), "expected the completed dump to be ingested")
+	write("third.csv", "bogus\n")
+	assert.Equal(t, "third.csv", wait(), "expected the failing dump to be ingested")
+
+	cancel()
+	assert.Nil(t, <-done, "Watch() failed, expected no error once done")
+	select {
+	case name := <-ingested:
+		t.Errorf("expected no other dump to be ingested, got %s", name)
+	default:
+	}
+
+	list := func(dir string) []string {
+		entries, err := os.ReadDir(dir)
+		assert.Nil(t, err, "ReadDir() failed, expected no error, got %v", err)
+		names := []string{}
+		for _, entry := range entries {
+			names = append(names, entry.Name()[strings.Index(entry.Name(), "_")+1:])
+		}
+		return names
+	}
+	assert.ElementsMatch(t, []string{"first.csv", "second.csv.gz"}, list(filepath.Join(dir, "archive")), "expected ingested dumps to be archived")
+	assert.ElementsMatch(t, []string{"third.csv"}, list(filepath.Join(dir, "failed")), "expected the failing dump to be moved aside")
+	_, err = os.Stat(filepath.Join(dir, ".second.csv"))
+	assert.Nil(t, err, "expected the hidden file to be left alone, got %v", err)
+}
+
+func TestWatcher_WatchArchiveFailed(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"first.csv", "second.csv"} {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(csv_header+"\n"), 0o644)
+		assert.Nil(t, err, "WriteFile() failed, expected no error, got %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	ingested := make(chan string, 10)
+	done := make(chan error, 1)
+	go func() {
+		w := NewWatcher(dir, WatchOptions{Settle: 50 * time.Millisecond})
+		done <- w.Watch(ctx, func(ctx context.Context, path string) error {
+			ingested <- filepath.Base(path)
+			// gone once ingested, so it can't be archived
+			return os.Remove(path)
+		})
+	}()
+
+	names := []string{}
+	for len(names) < 2 {
+		select {
+		case name := <-ingested:
+			names = append(names, name)
+		case err := <-done:
+			t.Fatalf("expected Watch() to go on once archiving failed, got %v", err)
+		case <-ctx.Done():
+			t.Fatalf("expected both dumps to be ingested, got %v", names)
+		}
+	}
+	assert.ElementsMatch(t, []string{"first.csv", "second.csv"}, names, "expected every dump to be ingested")
+	cancel()
+	assert.Nil(t, <-done, "Watch() failed, expected no error once done")
+}